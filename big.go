@@ -0,0 +1,227 @@
+// gobson - BSON library for Go.
+//
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bson
+
+import (
+	"big"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// --------------------------------------------------------------------------
+// Support for the arbitrary precision numbers of the big package.
+//
+// Values of type big.Int are marshaled as a Decimal128 when they have at
+// most 34 digits, which is the precision of that type, and otherwise as a
+// document holding their decimal representation as a string under the
+// single key "$bigInt", such as {"$bigInt": "-1234...890"}, so that they're
+// never truncated.  Such documents are unmarshaled into interface{} values
+// as a *big.Int rather than as an M value.  Values of type big.Rat are
+// marshaled as a string holding their fractional representation, such as
+// "1/3".  Both types may be unmarshaled from these representations, from
+// strings holding a number, and from any other numeric kind, as long as
+// the value is an integer in the case of big.Int.  Values which can't be
+// represented exactly, such as a NaN double or a string which isn't a
+// number, are skipped as incompatible values.
+//
+// The support is implemented as codecs registered via RegisterCodec, so
+// it may be replaced in the same way.
+
+func init() {
+	RegisterCodec(reflect.TypeOf(big.Int{}), encodeBigInt, decodeBigInt)
+	RegisterCodec(reflect.TypeOf(big.Rat{}), encodeBigRat, decodeBigRat)
+}
+
+// maxDecimal128Digits is the number of digits of precision of Decimal128.
+const maxDecimal128Digits = 34
+
+// bigIntKey is the key of the document marking a big.Int value too large
+// for a Decimal128.
+const bigIntKey = "$bigInt"
+
+func encodeBigInt(v reflect.Value) (kind byte, data []byte) {
+	s := addrOf(v).(*big.Int).String()
+	e := &encoder{}
+	if len(strings.TrimLeft(s, "-")) <= maxDecimal128Digits {
+		if dec, err := ParseDecimal128(s); err == nil {
+			e.addInt64(int64(dec.l))
+			e.addInt64(int64(dec.h))
+			return KindDecimal128, e.out
+		}
+	}
+	start := e.reserveInt32()
+	e.addElemName(KindString, bigIntKey)
+	e.addStr(s)
+	e.addBytes(0)
+	e.setInt32(start, int32(len(e.out)-start))
+	return KindDocument, e.out
+}
+
+func encodeBigRat(v reflect.Value) (kind byte, data []byte) {
+	e := &encoder{}
+	e.addStr(addrOf(v).(*big.Rat).String())
+	return KindString, e.out
+}
+
+func decodeBigInt(kind byte, data []byte, v reflect.Value) bool {
+	r, ok := parseBigRat(kind, data)
+	if !ok || !r.IsInt() {
+		return false
+	}
+	v.Set(reflect.ValueOf(*r.Num()))
+	return true
+}
+
+func decodeBigRat(kind byte, data []byte, v reflect.Value) bool {
+	r, ok := parseBigRat(kind, data)
+	if !ok {
+		return false
+	}
+	v.Set(reflect.ValueOf(*r))
+	return true
+}
+
+// isBigIntDoc returns whether the document at the start of data begins
+// with the string element marking a big.Int value.
+func isBigIntDoc(data []byte) bool {
+	n := 5 + len(bigIntKey)
+	return len(data) > n && data[4] == KindString &&
+		string(data[5:n]) == bigIntKey && data[n] == 0
+}
+
+// bigIntFromDoc returns the big.Int held by the valid document data, if
+// it holds nothing but the element marking a big.Int value.
+func bigIntFromDoc(data []byte) (n *big.Int, ok bool) {
+	if !isBigIntDoc(data) {
+		return nil, false
+	}
+	d := &decoder{in: data, i: 5 + len(bigIntKey) + 1}
+	s := d.readStr()
+	if d.i != len(data)-1 {
+		return nil, false
+	}
+	return new(big.Int).SetString(s, 10)
+}
+
+// readBigIntDoc reads the document at the current position as a big.Int
+// if it's marked as one.  Otherwise the position is left unchanged.
+func (d *decoder) readBigIntDoc() (n *big.Int, ok bool) {
+	if !isBigIntDoc(d.in[d.i:]) {
+		return nil, false
+	}
+	start := d.i
+	d.validateDoc()
+	if n, ok = bigIntFromDoc(d.in[start:d.i]); !ok {
+		d.i = start
+	}
+	return n, ok
+}
+
+// addrOf returns a pointer to the value held by v, which is copied if
+// it's not addressable.
+func addrOf(v reflect.Value) interface{} {
+	if v.CanAddr() {
+		return v.Addr().Interface()
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p.Interface()
+}
+
+// parseBigRat returns the exact value of the numeric element with the
+// given kind and data, which may also be a string holding a number.
+func parseBigRat(kind byte, data []byte) (r *big.Rat, ok bool) {
+	d := &decoder{in: data}
+	switch kind {
+	case KindInt32:
+		return big.NewRat(int64(d.readInt32()), 1), true
+	case KindInt64:
+		return big.NewRat(d.readInt64(), 1), true
+	case KindDouble:
+		f := d.readFloat64()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, false
+		}
+		return parseBigDecimal(strconv.Ftoa64(f, 'e', -1))
+	case KindDecimal128:
+		dec := Decimal128{l: uint64(d.readInt64()), h: uint64(d.readInt64())}
+		return parseBigDecimal(dec.String())
+	case KindDocument:
+		if n, ok := bigIntFromDoc(data); ok {
+			return new(big.Rat).SetFrac(n, big.NewInt(1)), true
+		}
+	case KindString:
+		s := d.readStr()
+		if i := strings.Index(s, "/"); i >= 0 && strings.Trim(s[i+1:], "0") == "" {
+			return nil, false // Zero denominator.
+		}
+		if r, ok := new(big.Rat).SetString(s); ok {
+			return r, true
+		}
+		return parseBigDecimal(s)
+	}
+	return nil, false
+}
+
+// maxBigExponent bounds the exponent of the numbers parsed, which is well
+// beyond the range of Decimal128 values, to prevent huge allocations.
+const maxBigExponent = 10000
+
+// parseBigDecimal parses the decimal number s, with an optional fraction
+// and exponent, as an exact rational number.  Both the format of the
+// String method of Decimal128 and of strconv.Ftoa64 are understood.
+func parseBigDecimal(s string) (r *big.Rat, ok bool) {
+	exp := 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil || e > maxBigExponent || e < -maxBigExponent {
+			return nil, false
+		}
+		exp, s = e, s[:i]
+	}
+	if i := strings.Index(s, "."); i >= 0 {
+		exp -= len(s) - i - 1
+		s = s[:i] + s[i+1:]
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, false
+	}
+	scale := big.NewInt(1)
+	if exp > 0 {
+		n.Mul(n, scale.Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+	} else if exp < 0 {
+		scale.Exp(big.NewInt(10), big.NewInt(int64(-exp)), nil)
+	}
+	return new(big.Rat).SetFrac(n, scale), true
+}
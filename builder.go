@@ -0,0 +1,233 @@
+// gobson - BSON library for Go.
+//
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bson
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"time"
+)
+
+// DocBuilder builds a BSON document by appending one element at a time,
+// without the reflection done by Marshal, which makes it suitable for
+// building documents of a known shape in performance critical code.
+// For instance:
+//
+//     b := bson.NewDocBuilder()
+//     b.AppendString("name", "Ada")
+//     b.StartArray("langs")
+//     b.AppendString("", "en")
+//     b.End()
+//     data := b.Finish()
+//
+// Elements appended within an array started with StartArray are keyed by
+// their index, and the name provided for them is ignored.  As with Marshal,
+// the methods panic if a name holds a NUL byte, since that can't be
+// represented in BSON, and on similar programming errors.
+type DocBuilder struct {
+	e encoder
+
+	// Open documents and arrays, from the outer document inwards.
+	levels []builderLevel
+}
+
+type builderLevel struct {
+	start int
+	array bool
+	n     int
+}
+
+// NewDocBuilder returns a new DocBuilder holding an empty document.
+func NewDocBuilder() *DocBuilder {
+	b := &DocBuilder{}
+	b.Reset()
+	return b
+}
+
+// Reset discards all the appended elements, while preserving the capacity
+// of the internal buffer so that the memory is reused by the next document.
+func (b *DocBuilder) Reset() {
+	b.e.out = b.e.out[:0]
+	b.levels = append(b.levels[:0], builderLevel{start: b.e.reserveInt32()})
+}
+
+func (b *DocBuilder) addElemName(kind byte, name string) {
+	level := &b.levels[len(b.levels)-1]
+	if level.array {
+		name = itoa(level.n)
+	}
+	level.n++
+	b.e.addElemName(kind, name)
+}
+
+// AppendDouble appends a BSON double element.
+func (b *DocBuilder) AppendDouble(name string, f float64) {
+	b.addElemName(KindDouble, name)
+	b.e.addInt64(int64(math.Float64bits(f)))
+}
+
+// AppendString appends a BSON string element.
+func (b *DocBuilder) AppendString(name, s string) {
+	b.addElemName(KindString, name)
+	b.e.addStr(s)
+}
+
+// AppendBinary appends a BSON binary element with the given subtype.
+func (b *DocBuilder) AppendBinary(name string, subtype byte, data []byte) {
+	b.addElemName(KindBinary, name)
+	b.e.addBinary(subtype, data)
+}
+
+// AppendObjectId appends a BSON ObjectId element.  It panics if id isn't
+// exactly 12 bytes long.
+func (b *DocBuilder) AppendObjectId(name string, id ObjectId) {
+	data := b.e.objectIdBytes(string(id))
+	b.addElemName(KindObjectId, name)
+	b.e.addBytes(data...)
+}
+
+// AppendBool appends a BSON boolean element.
+func (b *DocBuilder) AppendBool(name string, v bool) {
+	b.addElemName(KindBool, name)
+	if v {
+		b.e.addBytes(1)
+	} else {
+		b.e.addBytes(0)
+	}
+}
+
+// AppendTime appends a BSON UTC datetime element, holding t with
+// millisecond precision.
+func (b *DocBuilder) AppendTime(name string, t time.Time) {
+	b.addElemName(KindDateTime, name)
+	b.e.addInt64(timeToMs(t))
+}
+
+// AppendNull appends a BSON null element.
+func (b *DocBuilder) AppendNull(name string) {
+	b.addElemName(KindNull, name)
+}
+
+// AppendInt32 appends a BSON int32 element.
+func (b *DocBuilder) AppendInt32(name string, i int32) {
+	b.addElemName(KindInt32, name)
+	b.e.addInt32(i)
+}
+
+// AppendInt64 appends a BSON int64 element.
+func (b *DocBuilder) AppendInt64(name string, i int64) {
+	b.addElemName(KindInt64, name)
+	b.e.addInt64(i)
+}
+
+// AppendDecimal128 appends a BSON decimal128 element.
+func (b *DocBuilder) AppendDecimal128(name string, d Decimal128) {
+	b.addElemName(KindDecimal128, name)
+	b.e.addInt64(int64(d.l))
+	b.e.addInt64(int64(d.h))
+}
+
+// AppendRaw appends an element holding the already encoded raw value,
+// such as a document previously marshaled, without validating it.
+func (b *DocBuilder) AppendRaw(name string, raw Raw) {
+	kind := raw.Kind
+	if kind == 0x00 {
+		kind = KindDocument
+	}
+	b.addElemName(kind, name)
+	b.e.addBytes(raw.Data...)
+}
+
+// AppendValue appends an element holding value, marshaled as done by
+// Marshal for the values of a document, for kinds not covered by the
+// other methods.  If value can't be marshaled, nothing is appended and
+// the error is returned.
+func (b *DocBuilder) AppendValue(name string, value interface{}) (err os.Error) {
+	mark := len(b.e.out)
+	defer func() {
+		if r := recover(); r != nil {
+			b.e.out = b.e.out[:mark]
+			b.e.unvisit(0)
+			err = panicErr(r)
+		}
+	}()
+	level := &b.levels[len(b.levels)-1]
+	if level.array {
+		name = itoa(level.n)
+	}
+	b.e.addElem(name, reflect.ValueOf(value), false)
+	b.e.unvisit(0)
+	level.n++
+	return nil
+}
+
+// StartDocument appends a BSON document element, to which all further
+// elements are appended until the respective call to End.
+func (b *DocBuilder) StartDocument(name string) {
+	b.addElemName(KindDocument, name)
+	b.levels = append(b.levels, builderLevel{start: b.e.reserveInt32()})
+}
+
+// StartArray appends a BSON array element, to which all further elements
+// are appended, keyed by their index, until the respective call to End.
+func (b *DocBuilder) StartArray(name string) {
+	b.addElemName(KindArray, name)
+	b.levels = append(b.levels, builderLevel{start: b.e.reserveInt32(), array: true})
+}
+
+// End finishes the document or array started by the last call to
+// StartDocument or StartArray which wasn't ended yet.
+func (b *DocBuilder) End() {
+	if len(b.levels) < 2 {
+		panic("DocBuilder.End called without a matching StartDocument or StartArray")
+	}
+	b.endLevel()
+}
+
+func (b *DocBuilder) endLevel() {
+	start := b.levels[len(b.levels)-1].start
+	b.e.addBytes(0)
+	b.e.setInt32(start, int32(len(b.e.out)-start))
+	b.levels = b.levels[:len(b.levels)-1]
+}
+
+// Finish completes the document and returns its data, which is held in
+// the builder's buffer and is only valid until the builder is reset.
+// It panics if a document or array started within it wasn't ended.
+// No further elements may be appended until Reset is called.
+func (b *DocBuilder) Finish() []byte {
+	if len(b.levels) != 1 {
+		panic("DocBuilder.Finish called with unended documents or arrays")
+	}
+	b.endLevel()
+	return b.e.out
+}
@@ -31,14 +31,52 @@
 package bson
 
 import (
+	"encoding"
 	"reflect"
 	"math"
+	"net"
+	"strconv"
+	"time"
 	"fmt"
+	"unsafe"
 )
 
 type decoder struct {
-	in []byte
-	i  int
+	in     []byte
+	i      int
+	strict bool
+	loc    *time.Location
+
+	// Whether int64 values unmarshaled into time.Duration values are
+	// in milliseconds rather than nanoseconds.
+	durationMillis bool
+
+	// Whether strings read reference the input bytes rather than a copy.
+	unsafeStrings bool
+
+	// Whether int32 values unmarshaled into interface values become
+	// int64 values rather than int ones.
+	int64Ints bool
+
+	// Whether binary values of the generic subtype unmarshaled into
+	// interface values become Binary values rather than []byte ones.
+	alwaysBinary bool
+
+	// Whether int32 and int64 values may be unmarshaled into time.Time
+	// values as milliseconds since the epoch.
+	numericTimes bool
+
+	// Whether documents unmarshaled into interface values should
+	// become D values rather than M ones, preserving their order.
+	ordered bool
+
+	// Number of documents and arrays being read, from the outer
+	// document inwards.
+	depth int
+
+	// Maximum size of the documents read, replacing MaxDocumentSize
+	// if non-zero.
+	maxSize int
 }
 
 
@@ -64,12 +102,59 @@ func settableValueOf(i interface{}) reflect.Value {
 	return sv
 }
 
+// setIP sets out, a net.IP value, to the address held by in, which may be
+// either binary data or a string in the form accepted by net.ParseIP.
+func setIP(out reflect.Value, in interface{}) bool {
+	var ip net.IP
+	switch in := in.(type) {
+	case []byte:
+		ip = net.IP(in)
+	case Binary:
+		ip = net.IP(in.Data)
+	case string:
+		ip = net.ParseIP(in)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+	}
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return false
+	}
+	out.Set(reflect.ValueOf(ip))
+	return true
+}
+
 // --------------------------------------------------------------------------
 // Unmarshaling of documents.
 
 func (d *decoder) readDocTo(out reflect.Value) {
 	zeroNilPtr(out)
 
+	if unmarshaler, ok := out.Interface().(Unmarshaler); ok {
+		start := d.i
+		d.validateDoc()
+		if err := unmarshaler.UnmarshalBSON(d.in[start:d.i]); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if setter, ok := out.Interface().(RawSetter); ok {
+		start := d.i
+		d.validateDoc()
+		if err := setter.SetBSON(Raw{KindDocument, d.in[start:d.i]}); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if setter, ok := out.Interface().(SetterError); ok {
+		if err := setter.SetBSON(d.readDocD()); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	if setter, ok := out.Interface().(Setter); ok {
 		setter.SetBSON(d.readDocD())
 		return
@@ -86,10 +171,23 @@ func (d *decoder) readDocTo(out reflect.Value) {
 		}
 	case reflect.Ptr:
 		d.readDocTo(out.Elem())
+	case reflect.Slice:
+		switch out.Type() {
+		case typeD:
+			out.Set(reflect.ValueOf(d.readDocD()))
+		case typeRawD:
+			out.Set(reflect.ValueOf(d.readRawD()))
+		default:
+			panic("Unsupported document type for unmarshaling: " + out.Type().String())
+		}
 	case reflect.Interface:
 		if !out.IsNil() {
 			panic("Found non-nil interface. Please contact the developers.")
 		}
+		if d.ordered {
+			out.Set(reflect.ValueOf(d.readDocD()))
+			return
+		}
 		mv := reflect.ValueOf(make(M))
 		out.Set(mv)
 		d.readMapDocTo(mv)
@@ -100,8 +198,16 @@ func (d *decoder) readDocTo(out reflect.Value) {
 
 func (d *decoder) readMapDocTo(v reflect.Value) {
 	vt := v.Type()
-	if vt.Key().Kind() != reflect.String {
-		panic("BSON map must have string keys. Got: " + v.Type().String())
+	keyType := vt.Key()
+	textKey := reflect.PtrTo(keyType).Implements(typeTextUnmarshaler)
+	switch keyType.Kind() {
+	case reflect.String:
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		if !textKey {
+			panic("BSON map must have string or integer keys. Got: " + v.Type().String())
+		}
 	}
 	elemType := vt.Elem()
 	if v.IsNil() {
@@ -110,11 +216,45 @@ func (d *decoder) readMapDocTo(v reflect.Value) {
 	d.readDocWith(func(kind byte, name string) {
 		e := reflect.New(elemType).Elem()
 		if d.readElemTo(e, kind) {
-			v.SetMapIndex(reflect.ValueOf(name), e)
+			v.SetMapIndex(mapKeyValue(keyType, textKey, name), e)
 		}
 	})
 }
 
+// mapKeyValue returns the map key of type keyType for the document key
+// name, using the UnmarshalText method of keys implementing
+// encoding.TextUnmarshaler, or otherwise parsing it as a decimal number
+// for integer key types.
+func mapKeyValue(keyType reflect.Type, textKey bool, name string) reflect.Value {
+	if textKey {
+		kp := reflect.New(keyType)
+		err := kp.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(name))
+		if err != nil {
+			panic(fmt.Sprintf("Can't unmarshal document key %q into map key of type %s: %s", name, keyType.String(), err.String()))
+		}
+		return kp.Elem()
+	}
+	k := reflect.New(keyType).Elem()
+	switch keyType.Kind() {
+	case reflect.String:
+		k.SetString(name)
+		return k
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.Atoi64(name)
+		if err == nil && !k.OverflowInt(i) {
+			k.SetInt(i)
+			return k
+		}
+	default:
+		u, err := strconv.Atoui64(name)
+		if err == nil && !k.OverflowUint(u) {
+			k.SetUint(u)
+			return k
+		}
+	}
+	panic(fmt.Sprintf("Can't unmarshal document key %q into map key of type %s", name, keyType.String()))
+}
+
 func (d *decoder) readRawDocTo(out reflect.Value) {
 	start := d.i
 	d.readDocWith(func(kind byte, name string) {
@@ -123,15 +263,60 @@ func (d *decoder) readRawDocTo(out reflect.Value) {
 	out.Set(reflect.ValueOf(Raw{0x03, d.in[start:d.i]}))
 }
 
+// Find the element with the given name in the document at the current
+// position, returning it as a Raw value without unmarshaling it.
+func (d *decoder) lookupElem(key string) (elem Raw, ok bool) {
+	end := d.readDocEnd()
+	for d.in[d.i] != '\x00' {
+		kind, name := d.readElemName()
+		if d.i > end {
+			corrupted()
+		}
+		start := d.i
+		d.dropElem(kind)
+		if d.i >= end {
+			corrupted()
+		}
+		if name == key {
+			return Raw{kind, d.in[start:d.i]}, true
+		}
+	}
+	return Raw{}, false
+}
+
 func (d *decoder) readStructDocTo(out reflect.Value) {
 	fields, err := getStructFields(out.Type())
 	if err != nil {
 		panic(err)
 	}
 	fieldsMap := fields.Map
+	aliasesMap := fields.Aliases
+	// Lowest alias position unmarshaled for each field with aliases,
+	// so that keys of higher precedence win whatever their order.
+	var aliasSeen map[string]int
 	d.readDocWith(func(kind byte, name string) {
-		if info, ok := fieldsMap[name]; ok {
-			d.readElemTo(out.Field(info.Num), kind)
+		info, ok := fieldsMap[name]
+		if !ok && aliasesMap != nil {
+			info, ok = aliasesMap[name]
+		}
+		if ok && info.Aliases != nil {
+			if seen, found := aliasSeen[info.Key]; found && seen < info.Alias {
+				d.dropElem(kind)
+				return
+			}
+			if aliasSeen == nil {
+				aliasSeen = make(map[string]int)
+			}
+			aliasSeen[info.Key] = info.Alias
+		}
+		if ok {
+			if info.Inline == nil {
+				d.readElemTo(out.Field(info.Num), kind)
+			} else {
+				d.readElemTo(out.FieldByIndex(info.Inline), kind)
+			}
+		} else if d.strict {
+			panic(fmt.Sprintf("Document key %q has no matching field in %s", name, out.Type().String()))
 		} else {
 			d.dropElem(kind)
 		}
@@ -156,6 +341,7 @@ func (d *decoder) readArrayDoc(t reflect.Type) interface{} {
 }
 
 var typeD = reflect.TypeOf(D{})
+var typeRawD = reflect.TypeOf(RawD{})
 
 func (d *decoder) readDocD() interface{} {
 	slice := make(D, 0, 8)
@@ -169,16 +355,70 @@ func (d *decoder) readDocD() interface{} {
 	return slice
 }
 
-func (d *decoder) readDocWith(f func(kind byte, name string)) {
-	end := d.i - 4 + int(d.readInt32())
-	if end == d.i || end > len(d.in) || d.in[end-1] != '\x00' {
+func (d *decoder) readRawD() RawD {
+	slice := make(RawD, 0, 8)
+	d.readDocWith(func(kind byte, name string) {
+		start := d.i
+		d.validateElem(kind)
+		slice = append(slice, RawDocElem{name, Raw{kind, d.in[start:d.i]}})
+	})
+	return slice
+}
+
+// Read the length prefix of the document at the current position,
+// returning the position at which the document ends.
+func (d *decoder) readDocEnd() int {
+	if len(d.in)-d.i < 4 {
+		panic(ErrTruncated)
+	}
+	l := int(d.readInt32())
+	maxSize := d.maxSize
+	if maxSize == 0 {
+		maxSize = MaxDocumentSize
+	}
+	if l > maxSize {
+		panic(fmt.Sprintf("Document size %d exceeds the maximum of %d bytes", l, maxSize))
+	}
+	end := d.i - 4 + l
+	if l < 5 {
+		corrupted()
+	}
+	if end > len(d.in) {
+		panic(ErrTruncated)
+	}
+	if d.in[end-1] != '\x00' {
 		corrupted()
 	}
+	return end
+}
+
+// enterDoc accounts for a new document or array being read, failing if
+// it's nested deeper than MaxDocumentDepth.
+func (d *decoder) enterDoc() {
+	d.depth++
+	if d.depth > MaxDocumentDepth {
+		panic(fmt.Sprintf("Document nesting exceeds the maximum depth of %d", MaxDocumentDepth))
+	}
+}
+
+func (d *decoder) readDocWith(f func(kind byte, name string)) {
+	d.enterDoc()
+	end := d.readDocEnd()
+	var seen map[string]bool
+	if d.strict {
+		seen = make(map[string]bool)
+	}
 	for d.in[d.i] != '\x00' {
 		kind, name := d.readElemName()
 		if d.i > end {
 			corrupted()
 		}
+		if seen != nil {
+			if seen[name] {
+				panic(fmt.Sprintf("Duplicated key %q in document", name))
+			}
+			seen[name] = true
+		}
 		f(kind, name)
 		if d.i >= end {
 			corrupted()
@@ -188,6 +428,7 @@ func (d *decoder) readDocWith(f func(kind byte, name string)) {
 	if d.i != end {
 		corrupted()
 	}
+	d.depth--
 }
 
 
@@ -207,14 +448,66 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 
 	start := d.i
 
+	if c, found := lookupCodec(out.Type()); found && c.dec != nil {
+		d.validateElem(kind)
+		return c.dec(kind, d.in[start:d.i], out)
+	}
+
+	if out.Kind() == reflect.Ptr && kind != KindNull {
+		if c, found := lookupCodec(out.Type().Elem()); found && c.dec != nil {
+			d.validateElem(kind)
+			elem := out
+			if out.IsNil() {
+				elem = reflect.New(out.Type().Elem())
+			}
+			if !c.dec(kind, d.in[start:d.i], elem.Elem()) {
+				return false
+			}
+			out.Set(elem)
+			return true
+		}
+	}
+
+	if _, ok := out.Interface().(Unmarshaler); ok && kind == KindDocument {
+		d.readDocTo(out)
+		return true
+	}
+
+	if setter, ok := out.Interface().(RawSetter); ok {
+		// Skip over the element without unmarshaling it.
+		d.validateElem(kind)
+		if zeroNilPtr(out) {
+			setter = out.Interface().(RawSetter)
+		}
+		if err := setter.SetBSON(Raw{kind, d.in[start:d.i]}); err != nil {
+			panic(err)
+		}
+		return true
+	}
+
+	if out.Type() == typeRaw {
+		// Skip over the element without unmarshaling it.
+		d.validateElem(kind)
+		out.Set(reflect.ValueOf(Raw{kind, d.in[start:d.i]}))
+		return true
+	}
+
 	if kind == '\x03' {
 		// Special case for documents. Delegate to readDocTo().
 		switch out.Kind() {
-		case reflect.Interface, reflect.Ptr, reflect.Struct, reflect.Map:
+		case reflect.Interface:
+			if n, ok := d.readBigIntDoc(); ok {
+				out.Set(reflect.ValueOf(n))
+				return true
+			}
+			d.readDocTo(out)
+		case reflect.Ptr, reflect.Struct, reflect.Map:
 			d.readDocTo(out)
 		default:
 			if _, ok := out.Interface().(D); ok {
 				out.Set(reflect.ValueOf(d.readDocD()))
+			} else if out.Type() == typeRawD {
+				out.Set(reflect.ValueOf(d.readRawD()))
 			} else {
 				d.readDocTo(blackHole)
 			}
@@ -224,6 +517,10 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 
 	var in interface{}
 
+	// Milliseconds of a datetime, which time.Time values are built from
+	// directly, since a Timestamp only covers the years 1678 to 2262.
+	var datetimeMs int64
+
 	switch kind {
 	case '\x01': // Float64
 		in = d.readFloat64()
@@ -245,7 +542,7 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		}
 	case '\x05': // Binary
 		b := d.readBinary()
-		if b.Kind == 0x00 {
+		if b.Kind == 0x00 && !(d.alwaysBinary && out.Kind() == reflect.Interface) {
 			in = b.Data
 		} else {
 			in = b
@@ -257,28 +554,49 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 	case '\x08': // Bool
 		in = d.readBool()
 	case '\x09': // Timestamp
+		ms := d.readInt64()
+		if out.Type() == typePlainInt64 {
+			// Plain int64 values get the milliseconds as stored.
+			out.SetInt(ms)
+			return true
+		}
+		datetimeMs = ms
 		// MongoDB wants timestamps as milliseconds.
 		// Go likes nanoseconds.  Convert them.
-		in = Timestamp(d.readInt64() * 1e6)
+		in = Timestamp(ms * 1e6)
 	case '\x0A': // Nil
 		in = nil
 	case '\x0B': // RegEx
 		in = d.readRegEx()
+	case '\x0C': // DBPointer (deprecated)
+		in = DBPointer{d.readStr(), ObjectId(d.readBytes(12))}
 	case '\x0D': // JavaScript without scope
 		in = JS{Code: d.readStr()}
 	case '\x0E': // Symbol
 		in = Symbol(d.readStr())
 	case '\x0F': // JavaScript with scope
-		d.i += 4 // Skip length
+		l := int(d.readInt32())
 		js := JS{d.readStr(), make(M)}
 		d.readDocTo(reflect.ValueOf(js.Scope))
+		if d.i-start != l {
+			corrupted()
+		}
 		in = js
 	case '\x10': // Int32
-		in = int(d.readInt32())
+		if d.int64Ints && out.Kind() == reflect.Interface {
+			in = int64(d.readInt32())
+		} else {
+			in = int(d.readInt32())
+		}
 	case '\x11': // Mongo-specific timestamp
 		in = MongoTimestamp(d.readInt64())
 	case '\x12': // Int64
 		in = d.readInt64()
+	case '\x13': // Decimal128
+		in = Decimal128{
+			l: uint64(d.readInt64()),
+			h: uint64(d.readInt64()),
+		}
 	case '\x7F': // Max key
 		in = MaxKey
 	case '\xFF': // Min key
@@ -292,6 +610,16 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		return true
 	}
 
+	if setter, ok := out.Interface().(SetterError); ok {
+		if zeroNilPtr(out) {
+			setter = out.Interface().(SetterError)
+		}
+		if err := setter.SetBSON(in); err != nil {
+			panic(err)
+		}
+		return true
+	}
+
 	if setter, ok := out.Interface().(Setter); ok {
 		if zeroNilPtr(out) {
 			setter = out.Interface().(Setter)
@@ -300,7 +628,13 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 	}
 
 	if in == nil {
-		out.Set(reflect.Zero(out.Type()))
+		if out.Kind() == reflect.Ptr && out.Type().Elem().Kind() == reflect.Ptr {
+			// Initialize the outer pointer so that an explicit null
+			// may be told apart from a missing element.
+			out.Set(reflect.New(out.Type().Elem()))
+		} else {
+			out.Set(reflect.Zero(out.Type()))
+		}
 		return true
 	}
 
@@ -349,18 +683,34 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 			}
 		}
 	case reflect.Slice, reflect.Array:
+		if out.Type() == typeIP {
+			return setIP(out, in)
+		}
+		if b, ok := in.(Binary); ok && out.Type() == typeUUID {
+			uuid, err := b.UUID()
+			if err != nil {
+				return false
+			}
+			out.Set(reflect.ValueOf(UUID(uuid)))
+			return true
+		}
 		// Remember, array (0x04) slices are built with the correct element
 		// type.  If we are here, must be a cross BSON kind conversion.
 		if out.Type().Elem().Kind() == reflect.Uint8 {
 			switch inv.Kind() {
 			case reflect.String:
-				slice := []byte(inv.String())
-				out.Set(reflect.ValueOf(slice))
-				return true
+				if out.Kind() == reflect.Slice {
+					out.SetBytes([]byte(inv.String()))
+					return true
+				}
 			case reflect.Slice:
-				// out must be an array. A slice would trigger
-				// inv.Type() == out.Type() above.
-				reflect.Copy(out, inv)
+				if out.Kind() == reflect.Slice {
+					// A named type based on []byte. Plain []byte
+					// would trigger inv.Type() == out.Type() above.
+					out.SetBytes(inv.Bytes())
+				} else {
+					reflect.Copy(out, inv)
+				}
 				return true
 			}
 		}
@@ -370,16 +720,29 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 			// MongoDB wants timestamps as milliseconds.
 			// Go likes nanoseconds.  Convert them.
 			// out.Type() == inv.Type() has been handled above.
-			if out.Type() == typeTimestamp {
-				out.SetInt(inv.Int() * 1e6)
+			i := inv.Int()
+			if out.Type() == typeTimestamp || out.Type() == typeDuration && d.durationMillis {
+				if i > math.MaxInt64/1e6 || i < math.MinInt64/1e6 {
+					return d.overflow(out, kind)
+				}
+				i *= 1e6
 			} else if inv.Type() == typeTimestamp {
-				out.SetInt(inv.Int() / 1e6)
-			} else {
-				out.SetInt(inv.Int())
+				i /= 1e6
+			}
+			if out.OverflowInt(i) {
+				return d.overflow(out, kind)
 			}
+			out.SetInt(i)
 			return true
 		case reflect.Float32, reflect.Float64:
-			out.SetInt(int64(inv.Float()))
+			f := inv.Float()
+			if out.Type() == typeDuration && d.durationMillis {
+				f *= 1e6
+			}
+			if !(f >= -(1<<63) && f < 1<<63) || out.OverflowInt(int64(f)) {
+				return d.overflow(out, kind)
+			}
+			out.SetInt(int64(f))
 			return true
 		case reflect.Bool:
 			if inv.Bool() {
@@ -394,10 +757,18 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		switch inv.Kind() {
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			out.SetUint(uint64(inv.Int()))
+			i := inv.Int()
+			if i < 0 || out.OverflowUint(uint64(i)) {
+				return d.overflow(out, kind)
+			}
+			out.SetUint(uint64(i))
 			return true
 		case reflect.Float32, reflect.Float64:
-			out.SetUint(uint64(inv.Float()))
+			f := inv.Float()
+			if !(f > -1 && f < 1<<64) || out.OverflowUint(uint64(f)) {
+				return d.overflow(out, kind)
+			}
+			out.SetUint(uint64(f))
 			return true
 		case reflect.Bool:
 			if inv.Bool() {
@@ -412,6 +783,9 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 	case reflect.Float32, reflect.Float64:
 		switch inv.Kind() {
 		case reflect.Float32, reflect.Float64:
+			if out.OverflowFloat(inv.Float()) {
+				return d.overflow(out, kind)
+			}
 			out.SetFloat(inv.Float())
 			return true
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
@@ -427,6 +801,26 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 			panic("Can't happen. No uint types in BSON?")
 		}
+	case reflect.Struct:
+		if out.Type() != typeTime {
+			break
+		}
+		var ms int64
+		if kind == KindDateTime {
+			ms = datetimeMs
+		} else if inv.Type() == typeTimestamp {
+			ms = inv.Int() / 1e6
+		} else if d.numericTimes && (inv.Kind() == reflect.Int || inv.Type() == typePlainInt64) {
+			ms = inv.Int()
+		} else {
+			break
+		}
+		t := msToTime(ms)
+		if d.loc != nil && !t.IsZero() {
+			t = t.In(d.loc)
+		}
+		out.Set(reflect.ValueOf(t))
+		return true
 	case reflect.Bool:
 		switch inv.Kind() {
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
@@ -443,6 +837,90 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 	return false
 }
 
+// overflow handles a numeric value of the given kind which doesn't fit in
+// out.  It's skipped as any incompatible value, unless unmarshaling in
+// strict mode.
+func (d *decoder) overflow(out reflect.Value, kind byte) (good bool) {
+	if d.strict {
+		panic(&TypeError{out.Type(), kind})
+	}
+	return false
+}
+
+// --------------------------------------------------------------------------
+// Validation of documents without unmarshaling them.
+
+func (d *decoder) validateDoc() {
+	d.enterDoc()
+	end := d.readDocEnd()
+	for d.in[d.i] != '\x00' {
+		kind := d.readByte()
+		d.readBytesUpto('\x00')
+		if d.i > end {
+			corrupted()
+		}
+		d.validateElem(kind)
+		if d.i >= end {
+			corrupted()
+		}
+	}
+	d.i++ // '\x00'
+	if d.i != end {
+		corrupted()
+	}
+	d.depth--
+}
+
+func (d *decoder) validateElem(kind byte) {
+	switch kind {
+	case '\x01', '\x09', '\x11', '\x12': // Float64, Timestamp, Mongo timestamp, Int64
+		d.readBytes(8)
+	case '\x02', '\x0D', '\x0E': // UTF-8 string, JavaScript, Symbol
+		d.validateStr()
+	case '\x03', '\x04': // Document, Array
+		d.validateDoc()
+	case '\x05': // Binary
+		d.readBinary()
+	case '\x06', '\x0A', '\x7F', '\xFF': // Undefined, Nil, Max key, Min key
+	case '\x07': // ObjectId
+		d.readBytes(12)
+	case '\x08': // Bool
+		if d.readByte() > 1 {
+			corrupted()
+		}
+	case '\x0B': // RegEx
+		d.readBytesUpto('\x00')
+		d.readBytesUpto('\x00')
+	case '\x0C': // DBPointer
+		d.validateStr()
+		d.readBytes(12)
+	case '\x0F': // JavaScript with scope
+		start := d.i
+		l := int(d.readInt32())
+		d.validateStr()
+		d.validateDoc()
+		if d.i-start != l {
+			corrupted()
+		}
+	case '\x10': // Int32
+		d.readBytes(4)
+	case '\x13': // Decimal128
+		d.readBytes(16)
+	default:
+		panic(fmt.Sprintf("Unknown element kind (0x%02X)", kind))
+	}
+}
+
+func (d *decoder) validateStr() {
+	l := d.readInt32()
+	if l < 1 {
+		corrupted()
+	}
+	d.readBytes(l - 1)
+	if d.readByte() != '\x00' {
+		corrupted()
+	}
+}
 
 // --------------------------------------------------------------------------
 // Parsers of basic types.
@@ -465,6 +943,9 @@ func (d *decoder) readBinary() Binary {
 	b.Data = d.readBytes(l)
 	if b.Kind == 0x02 {
 		// Weird obsolete format with redundant length.
+		if l < 4 || getInt32(b.Data) != l-4 {
+			corrupted()
+		}
 		b.Data = b.Data[4:]
 	}
 	return b
@@ -476,6 +957,10 @@ func (d *decoder) readStr() string {
 	if d.readByte() != '\x00' {
 		corrupted()
 	}
+	if d.unsafeStrings {
+		// A string header is a prefix of a slice header.
+		return *(*string)(unsafe.Pointer(&b))
+	}
 	return string(b)
 }
 
@@ -495,7 +980,10 @@ func (d *decoder) readFloat64() float64 {
 }
 
 func (d *decoder) readInt32() int32 {
-	b := d.readBytes(4)
+	return getInt32(d.readBytes(4))
+}
+
+func getInt32(b []byte) int32 {
 	return int32((uint32(b[0]) << 0) |
 		(uint32(b[1]) << 8) |
 		(uint32(b[2]) << 16) |
@@ -526,7 +1014,7 @@ func (d *decoder) readByte() byte {
 func (d *decoder) readBytes(length int32) []byte {
 	start := d.i
 	d.i += int(length)
-	if d.i > len(d.in) {
+	if length < 0 || d.i > len(d.in) {
 		corrupted()
 	}
 	return d.in[start : start+int(length)]
@@ -31,9 +31,16 @@
 package bson
 
 import (
+	"encoding"
+	"fmt"
 	"strconv"
+	"strings"
 	"reflect"
 	"math"
+	"net"
+	"sort"
+	"time"
+	"os"
 )
 
 // --------------------------------------------------------------------------
@@ -48,7 +55,16 @@ var (
 	typeMongoTimestamp reflect.Type
 	typeOrderKey       reflect.Type
 	typeDocElem        reflect.Type
+	typeRawDocElem     reflect.Type
 	typeRaw            reflect.Type
+	typeTime           reflect.Type
+	typeDuration       reflect.Type
+	typeInt64          reflect.Type
+	typePlainInt64     reflect.Type
+	typeUUID           reflect.Type
+	typeIP             reflect.Type
+
+	typeTextUnmarshaler reflect.Type
 )
 
 const itoaCacheSize = 32
@@ -63,7 +79,15 @@ func init() {
 	typeMongoTimestamp = reflect.TypeOf(MongoTimestamp(0))
 	typeOrderKey = reflect.TypeOf(MinKey)
 	typeDocElem = reflect.TypeOf(DocElem{})
+	typeRawDocElem = reflect.TypeOf(RawDocElem{})
 	typeRaw = reflect.TypeOf(Raw{})
+	typeTime = reflect.TypeOf(time.Time{})
+	typeDuration = reflect.TypeOf(time.Duration(0))
+	typeInt64 = reflect.TypeOf(Int64(0))
+	typePlainInt64 = reflect.TypeOf(int64(0))
+	typeUUID = reflect.TypeOf(UUID{})
+	typeIP = reflect.TypeOf(net.IP{})
+	typeTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
 
 	itoaCache = make([]string, itoaCacheSize)
 	for i := 0; i != itoaCacheSize; i++ {
@@ -83,16 +107,94 @@ func itoa(i int) string {
 // Marshaling of the document value itself.
 
 type encoder struct {
-	out []byte
+	out               []byte
+	sortKeys          bool
+	reinterpretUint64 bool
+	nilAsNull         bool
+	stringerFallback  bool
+	durationMillis    bool
+	nonFinite         NonFiniteMode
+	ipAsString        bool
+	hexObjectIds      bool
+
+	// Keys of the elements being marshaled, from the outer document
+	// inwards, so that failures may be reported with their location.
+	path []string
+
+	// Pointers and maps being marshaled, from the outer document inwards,
+	// so that cycles are reported rather than recursing forever.
+	visiting   map[visitKey]bool
+	visitStack []visitKey
+}
+
+type visitKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// visit records that the pointer or map v is being marshaled, failing if
+// it's already being marshaled by an outer element.
+func (e *encoder) visit(v reflect.Value) {
+	key := visitKey{v.Pointer(), v.Type()}
+	if e.visiting == nil {
+		e.visiting = make(map[visitKey]bool)
+	} else if e.visiting[key] {
+		panic("Can't marshal cyclic data structure: " + v.Type().String() + " refers to itself")
+	}
+	e.visiting[key] = true
+	e.visitStack = append(e.visitStack, key)
+}
+
+// unvisit forgets the pointers and maps visited since the visit stack
+// had length mark.
+func (e *encoder) unvisit(mark int) {
+	for _, key := range e.visitStack[mark:] {
+		e.visiting[key] = false, false
+	}
+	e.visitStack = e.visitStack[:mark]
+}
+
+// reset truncates the buffer and drops the location of the element being
+// marshaled, so that the encoder may be reused even after a failure.
+func (e *encoder) reset() {
+	e.out = e.out[:0]
+	e.path = e.path[:0]
+	e.unvisit(0)
+}
+
+// handleErr works like the handleErr function, but also reports the path
+// to the element being marshaled when the failure happened.
+func (e *encoder) handleErr(err *os.Error) {
+	if r := recover(); r != nil {
+		*err = panicErr(r)
+		if len(e.path) > 0 {
+			*err = &FieldError{strings.Join(e.path, "."), *err}
+		}
+	}
 }
 
 func (e *encoder) addDoc(v reflect.Value) {
 	for {
+		if !v.IsValid() {
+			panic("Can't marshal nil as a BSON document")
+		}
+		if vi, ok := v.Interface().(Marshaler); ok {
+			e.addBytes(marshalBSON(vi)...)
+			return
+		}
+		if vi, ok := v.Interface().(GetterError); ok {
+			v = reflect.ValueOf(getBSON(vi))
+			continue
+		}
 		if vi, ok := v.Interface().(Getter); ok {
 			v = reflect.ValueOf(vi.GetBSON())
 			continue
 		}
 		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				panic("Can't marshal nil " + v.Type().String() + " as a BSON document")
+			}
+			e.visit(v)
 			v = v.Elem()
 			continue
 		}
@@ -101,7 +203,7 @@ func (e *encoder) addDoc(v reflect.Value) {
 
 	if v.Type() == typeRaw {
 		raw := v.Interface().(Raw)
-		if raw.Kind != 0x03 && raw.Kind != 0x00 {
+		if raw.Kind != KindDocument && raw.Kind != 0x00 {
 			panic("Attempted to unmarshal Raw kind " + strconv.Itoa(int(raw.Kind)) + " as a document")
 		}
 		e.addBytes(raw.Data...)
@@ -112,6 +214,7 @@ func (e *encoder) addDoc(v reflect.Value) {
 
 	switch v.Kind() {
 	case reflect.Map:
+		e.visit(v)
 		e.addMap(v)
 	case reflect.Struct:
 		e.addStruct(v)
@@ -126,26 +229,103 @@ func (e *encoder) addDoc(v reflect.Value) {
 }
 
 func (e *encoder) addMap(v reflect.Value) {
-	for _, k := range v.MapKeys() {
-		e.addElem(k.String(), v.MapIndex(k), false)
+	keys := v.MapKeys()
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = mapKeyName(k)
+	}
+	if e.sortKeys {
+		sort.Sort(keyList{names, keys})
+	}
+	for i, k := range keys {
+		e.addField(names[i], v.MapIndex(k), false)
 	}
 }
 
+// mapKeyName returns the document key for the map key k.  Keys in BSON
+// are always strings, so keys implementing encoding.TextMarshaler are
+// converted into the text returned by their MarshalText method.  Integer
+// keys are converted into their decimal representation, unless they
+// implement fmt.Stringer and their pointer implements
+// encoding.TextUnmarshaler, so that the result of their String method can
+// be parsed back.  Other non-string keys implementing fmt.Stringer are
+// converted into the result of their String method, which can't be
+// unmarshaled back.
+func mapKeyName(k reflect.Value) string {
+	if marshaler, ok := k.Interface().(encoding.TextMarshaler); ok {
+		text, err := marshaler.MarshalText()
+		if err != nil {
+			panic(err)
+		}
+		return string(text)
+	}
+	if k.Kind() == reflect.String {
+		return k.String()
+	}
+	if stringer, ok := k.Interface().(fmt.Stringer); ok && (!isIntKind(k.Kind()) ||
+		reflect.PtrTo(k.Type()).Implements(typeTextUnmarshaler)) {
+		return stringer.String()
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.Itoa64(k.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.Uitoa64(k.Uint())
+	}
+	panic("Can't marshal map key of type " + k.Type().String())
+}
+
+func isIntKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+type keyList struct {
+	names []string
+	keys  []reflect.Value
+}
+
+func (l keyList) Len() int           { return len(l.names) }
+func (l keyList) Less(i, j int) bool { return l.names[i] < l.names[j] }
+func (l keyList) Swap(i, j int) {
+	l.names[i], l.names[j] = l.names[j], l.names[i]
+	l.keys[i], l.keys[j] = l.keys[j], l.keys[i]
+}
+
 func (e *encoder) addStruct(v reflect.Value) {
 	fields, err := getStructFields(v.Type())
 	if err != nil {
 		panic(err)
 	}
-	for i, info := range fields.List {
-		value := v.Field(i)
+	e.addStructFields(v, fields)
+}
+
+func (e *encoder) addStructFields(v reflect.Value, fields *structFields) {
+	for _, info := range fields.List {
+		var value reflect.Value
+		if info.Inline == nil {
+			value = v.Field(info.Num)
+		} else {
+			value = v.FieldByIndex(info.Inline)
+		}
 		if info.Conditional && isZero(value) {
 			continue
 		}
-		e.addElem(info.Key, value, info.Short)
+		e.addField(info.Key, value, info.Short)
 	}
 }
 
 func isZero(v reflect.Value) bool {
+	switch v.Type() {
+	case typeObjectId:
+		return ObjectId(v.String()).IsZero()
+	case typeTime:
+		return v.Interface().(time.Time).IsZero()
+	}
 	switch v.Kind() {
 	case reflect.String:
 		return len(v.String()) == 0
@@ -168,44 +348,160 @@ func isZero(v reflect.Value) bool {
 func (e *encoder) addSlice(v reflect.Value) {
 	if d, ok := v.Interface().(D); ok {
 		for _, elem := range d {
-			e.addElem(elem.Name, reflect.ValueOf(elem.Value), false)
+			e.addField(elem.Name, reflect.ValueOf(elem.Value), false)
+		}
+	} else if d, ok := v.Interface().(RawD); ok {
+		for _, elem := range d {
+			e.addField(elem.Name, reflect.ValueOf(elem.Value), false)
 		}
+	} else if isPlainStruct(v.Type().Elem()) {
+		e.addStructSlice(v)
 	} else {
 		for i := 0; i != v.Len(); i++ {
-			e.addElem(itoa(i), v.Index(i), false)
+			e.addField(itoa(i), v.Index(i), false)
 		}
 	}
 }
 
+// addStructSlice adds the elements of the slice or array v, holding plain
+// struct values, as documents.  All the elements share the same layout, so
+// the struct fields are looked up only once.
+func (e *encoder) addStructSlice(v reflect.Value) {
+	fields, err := getStructFields(v.Type().Elem())
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i != v.Len(); i++ {
+		name := itoa(i)
+		e.path = append(e.path, name)
+		e.addElemName(KindDocument, name)
+		start := e.reserveInt32()
+		e.addStructFields(v.Index(i), fields)
+		e.addBytes(0)
+		e.setInt32(start, int32(len(e.out)-start))
+		e.path = e.path[:len(e.path)-1]
+	}
+}
+
+// isPlainStruct returns whether values of type t are marshaled as
+// documents holding their fields, with no special handling.
+func isPlainStruct(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	if _, found := lookupCodec(t); found {
+		return false
+	}
+	switch reflect.Zero(t).Interface().(type) {
+	case Marshaler, GetterError, Getter:
+		return false
+	case Raw, Binary, RegEx, JS, undefined, DBPointer, Decimal128, time.Time:
+		return false
+	}
+	return true
+}
+
 
 // --------------------------------------------------------------------------
 // Marshaling of elements in a document.
 
 func (e *encoder) addElemName(kind byte, name string) {
+	if strings.Index(name, "\x00") >= 0 {
+		panic(fmt.Sprintf("BSON element name %q contains a NUL byte", name))
+	}
 	e.addBytes(kind)
 	e.addBytes([]byte(name)...)
 	e.addBytes(0)
 }
 
-func (e *encoder) addElem(name string, v reflect.Value, short bool) {
+// addField adds the element to the document while tracking its path.
+func (e *encoder) addField(name string, v reflect.Value, short bool) {
+	e.path = append(e.path, name)
+	mark := len(e.visitStack)
+	e.addElem(name, v, short)
+	e.unvisit(mark)
+	e.path = e.path[:len(e.path)-1]
+}
 
-	if !v.IsValid() {
-		e.addElemName('\x0A', name)
-		return
+// objectIdBytes returns the 12 bytes of the id s, aborting the marshaling
+// if it has a different length.  A 24 bytes long hex representation is
+// a common mistake, so it's either decoded or reported explicitly.
+func (e *encoder) objectIdBytes(s string) []byte {
+	if len(s) == 12 {
+		return []byte(s)
+	}
+	if IsObjectIdHex(s) {
+		if e.hexObjectIds {
+			return []byte(ObjectIdHex(s))
+		}
+		panic(fmt.Sprintf("ObjectIDs must be exactly 12 bytes long (got the "+
+			"24 bytes long hex representation %q; use ObjectIdHex to convert it)", s))
 	}
+	panic("ObjectIDs must be exactly 12 bytes long (got " + strconv.Itoa(len(s)) + ")")
+}
 
-	if getter, ok := v.Interface().(Getter); ok {
-		e.addElem(name, reflect.ValueOf(getter.GetBSON()), short)
-		return
+// getBSON calls the GetBSON method of getter, aborting the marshaling
+// if it fails.
+func getBSON(getter GetterError) interface{} {
+	v, err := getter.GetBSON()
+	if err != nil {
+		panic(err)
 	}
+	return v
+}
 
-	switch v.Kind() {
+// marshalBSON calls the MarshalBSON method of marshaler, aborting the
+// marshaling if it fails or if the result is not a single document.
+func marshalBSON(marshaler Marshaler) []byte {
+	data, err := marshaler.MarshalBSON()
+	if err != nil {
+		panic(err)
+	}
+	if l, err := DocumentLength(data); err != nil || l != len(data) || data[l-1] != 0 {
+		panic("MarshalBSON returned an invalid document")
+	}
+	return data
+}
 
-	case reflect.Interface:
-		e.addElem(name, v.Elem(), short)
+func (e *encoder) addElem(name string, v reflect.Value, short bool) {
 
-	case reflect.Ptr:
-		e.addElem(name, v.Elem(), short)
+	// Unwrap getters, pointers and interfaces until a concrete value is
+	// found, however deeply nested, marshaling nil values as null.
+	for {
+		if !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			e.addElemName(KindNull, name)
+			return
+		}
+		if c, found := lookupCodec(v.Type()); found && c.enc != nil {
+			kind, data := c.enc(v)
+			e.addElemName(kind, name)
+			e.addBytes(data...)
+			return
+		}
+		if marshaler, ok := v.Interface().(Marshaler); ok {
+			e.addElemName(KindDocument, name)
+			e.addBytes(marshalBSON(marshaler)...)
+			return
+		}
+		if getter, ok := v.Interface().(GetterError); ok {
+			v = reflect.ValueOf(getBSON(getter))
+			continue
+		}
+		if getter, ok := v.Interface().(Getter); ok {
+			v = reflect.ValueOf(getter.GetBSON())
+			continue
+		}
+		if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.Kind() == reflect.Ptr {
+				e.visit(v)
+			}
+			v = v.Elem()
+			continue
+		}
+		break
+	}
+
+	switch v.Kind() {
 
 	case reflect.String:
 		s := v.String()
@@ -213,41 +509,46 @@ func (e *encoder) addElem(name string, v reflect.Value, short bool) {
 		switch v.Type() {
 
 		case typeObjectId:
-			if len(s) != 12 {
-				panic("ObjectIDs must be exactly 12 bytes long (got " +
-					strconv.Itoa(len(s)) + ")")
-			}
-			e.addElemName('\x07', name)
-			e.addBytes([]byte(s)...)
+			id := e.objectIdBytes(s)
+			e.addElemName(KindObjectId, name)
+			e.addBytes(id...)
 
 		case typeSymbol:
-			e.addElemName('\x0E', name)
+			e.addElemName(KindSymbol, name)
 			e.addStr(s)
 
 		default:
-			e.addElemName('\x02', name)
+			e.addElemName(KindString, name)
 			e.addStr(s)
 		}
 
 	case reflect.Float32, reflect.Float64:
-		e.addElemName('\x01', name)
-		e.addInt64(int64(math.Float64bits(v.Float())))
+		f := v.Float()
+		if e.nonFinite != NonFinitePass && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			if e.nonFinite == NonFiniteNull {
+				e.addElemName(KindNull, name)
+				return
+			}
+			panic("Can't marshal non-finite float value " + strconv.Ftoa64(f, 'g', -1))
+		}
+		e.addElemName(KindDouble, name)
+		e.addInt64(int64(math.Float64bits(f)))
 
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		u := v.Uint()
-		if int64(u) < 0 {
+		if int64(u) < 0 && !e.reinterpretUint64 {
 			panic("BSON has no uint64 type, and value is too large to fit correctly in an int64")
 		} else if u <= math.MaxInt32 && (short || v.Kind() <= reflect.Uint32) {
-			e.addElemName('\x10', name)
+			e.addElemName(KindInt32, name)
 			e.addInt32(int32(u))
 		} else {
-			e.addElemName('\x12', name)
+			e.addElemName(KindInt64, name)
 			e.addInt64(int64(u))
 		}
 
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		if v.Type().Kind() <= reflect.Int32 {
-			e.addElemName('\x10', name)
+			e.addElemName(KindInt32, name)
 			e.addInt32(int32(v.Int()))
 		} else {
 			switch v.Type() {
@@ -255,35 +556,47 @@ func (e *encoder) addElem(name string, v reflect.Value, short bool) {
 			case typeTimestamp:
 				// MongoDB wants timestamps as milliseconds.
 				// Go likes nanoseconds.  Convert them.
-				e.addElemName('\x09', name)
+				e.addElemName(KindDateTime, name)
 				e.addInt64(v.Int() / 1e6)
 
 			case typeMongoTimestamp:
-				e.addElemName('\x11', name)
+				e.addElemName(KindMongoTimestamp, name)
 				e.addInt64(v.Int())
 
+			case typeInt64:
+				e.addElemName(KindInt64, name)
+				e.addInt64(v.Int())
+
+			case typeDuration:
+				i := v.Int()
+				if e.durationMillis {
+					i /= 1e6
+				}
+				e.addElemName(KindInt64, name)
+				e.addInt64(i)
+
 			case typeOrderKey:
 				if v.Int() == int64(MaxKey) {
-					e.addElemName('\x7F', name)
+					e.addElemName(KindMaxKey, name)
 				} else {
-					e.addElemName('\xFF', name)
+					e.addElemName(KindMinKey, name)
 				}
 
 			default:
 				i := v.Int()
 				if short && i >= math.MinInt32 && i <= math.MaxInt32 {
 					// It fits into an int32, encode as such.
-					e.addElemName('\x10', name)
+					e.addElemName(KindInt32, name)
 					e.addInt32(int32(i))
 				} else {
-					e.addElemName('\x12', name)
+					e.addElemName(KindInt64, name)
 					e.addInt64(i)
 				}
 			}
 		}
 
 	case reflect.Bool:
-		e.addElemName('\x08', name)
+		e.addElemName(KindBool, name)
 		if v.Bool() {
 			e.addBytes(1)
 		} else {
@@ -291,31 +604,48 @@ func (e *encoder) addElem(name string, v reflect.Value, short bool) {
 		}
 
 	case reflect.Map:
-		e.addElemName('\x03', name)
+		if e.nilAsNull && v.IsNil() {
+			e.addElemName(KindNull, name)
+			return
+		}
+		e.addElemName(KindDocument, name)
 		e.addDoc(v)
 
 	case reflect.Slice:
+		if e.nilAsNull && v.IsNil() {
+			e.addElemName(KindNull, name)
+			return
+		}
 		vt := v.Type()
 		et := vt.Elem()
-		if et.Kind() == reflect.Uint8 {
-			// FIXME: This breaks down with custom types based on []byte
-			e.addElemName('\x05', name)
-			e.addBinary('\x00', v.Interface().([]byte))
-		} else if et == typeDocElem {
-			e.addElemName('\x03', name)
+		if vt == typeIP && e.ipAsString && v.Len() == 0 {
+			// There's no address to format, rather than "<nil>".
+			e.addElemName(KindNull, name)
+		} else if vt == typeIP && e.ipAsString {
+			e.addElemName(KindString, name)
+			e.addStr(v.Interface().(net.IP).String())
+		} else if et.Kind() == reflect.Uint8 {
+			e.addElemName(KindBinary, name)
+			e.addBinary('\x00', v.Bytes())
+		} else if et == typeDocElem || et == typeRawDocElem {
+			e.addElemName(KindDocument, name)
 			e.addDoc(v)
 		} else {
-			e.addElemName('\x04', name)
+			e.addElemName(KindArray, name)
 			e.addDoc(v)
 		}
 
 	case reflect.Array:
 		et := v.Type().Elem()
-		if et.Kind() == reflect.Uint8 {
-			e.addElemName('\x05', name)
+		if v.Type() == typeUUID {
+			uuid := v.Interface().(UUID)
+			e.addElemName(KindBinary, name)
+			e.addBinary('\x04', uuid[:])
+		} else if et.Kind() == reflect.Uint8 {
+			e.addElemName(KindBinary, name)
 			e.addBinary('\x00', v.Slice(0, v.Len()).Interface().([]byte))
 		} else {
-			e.addElemName('\x04', name)
+			e.addElemName(KindArray, name)
 			e.addDoc(v)
 		}
 
@@ -325,26 +655,34 @@ func (e *encoder) addElem(name string, v reflect.Value, short bool) {
 		case Raw:
 			kind := s.Kind
 			if kind == 0x00 {
-				kind = 0x03
+				kind = KindDocument
 			}
 			e.addElemName(kind, name)
 			e.addBytes(s.Data...)
 
 		case Binary:
-			e.addElemName('\x05', name)
+			e.addElemName(KindBinary, name)
 			e.addBinary(s.Kind, s.Data)
 
 		case RegEx:
-			e.addElemName('\x0B', name)
+			s = s.Normalize()
+			for _, c := range s.Options {
+				switch c {
+				case 'i', 'l', 'm', 's', 'u', 'x':
+				default:
+					panic("Unsupported RegEx option: " + strconv.Quote(string([]int{c})))
+				}
+			}
+			e.addElemName(KindRegEx, name)
 			e.addCStr(s.Pattern)
 			e.addCStr(s.Options)
 
 		case JS:
 			if s.Scope == nil {
-				e.addElemName('\x0D', name)
+				e.addElemName(KindJavaScript, name)
 				e.addStr(s.Code)
 			} else {
-				e.addElemName('\x0F', name)
+				e.addElemName(KindJavaScriptWithScope, name)
 				start := e.reserveInt32()
 				e.addStr(s.Code)
 				e.addDoc(reflect.ValueOf(s.Scope))
@@ -352,15 +690,37 @@ func (e *encoder) addElem(name string, v reflect.Value, short bool) {
 			}
 
 		case undefined:
-			e.addElemName('\x06', name)
+			e.addElemName(KindUndefined, name)
+
+		case DBPointer:
+			id := e.objectIdBytes(string(s.Id))
+			e.addElemName(KindDBPointer, name)
+			e.addStr(s.Namespace)
+			e.addBytes(id...)
+
+		case Decimal128:
+			e.addElemName(KindDecimal128, name)
+			e.addInt64(int64(s.l))
+			e.addInt64(int64(s.h))
+
+		case time.Time:
+			// MongoDB wants timestamps as milliseconds.
+			// Go likes nanoseconds.  Convert them.
+			e.addElemName(KindDateTime, name)
+			e.addInt64(timeToMs(s))
 
 		default:
-			e.addElemName('\x03', name)
+			e.addElemName(KindDocument, name)
 			e.addDoc(v)
 		}
 
 	default:
-		panic("Can't marshal " + v.Type().String() + " in a BSON document")
+		if stringer, ok := v.Interface().(fmt.Stringer); ok && e.stringerFallback {
+			e.addElemName(KindString, name)
+			e.addStr(stringer.String())
+			return
+		}
+		panic(&MarshalError{v.Type(), ErrUnsupportedType})
 	}
 }
 
@@ -382,11 +742,16 @@ func (e *encoder) addBinary(subtype byte, v []byte) {
 }
 
 func (e *encoder) addStr(v string) {
+	// Unlike cstrings, length-prefixed strings may hold NUL bytes.
 	e.addInt32(int32(len(v) + 1))
-	e.addCStr(v)
+	e.addBytes([]byte(v)...)
+	e.addBytes(0)
 }
 
 func (e *encoder) addCStr(v string) {
+	if strings.Index(v, "\x00") >= 0 {
+		panic(fmt.Sprintf("BSON cstring %q contains a NUL byte", v))
+	}
 	e.addBytes([]byte(v)...)
 	e.addBytes(0)
 }
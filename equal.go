@@ -0,0 +1,188 @@
+// gobson - BSON library for Go.
+//
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bson
+
+import (
+	"bytes"
+	"math"
+	"os"
+)
+
+// --------------------------------------------------------------------------
+// Comparison of BSON values.
+
+// Equal returns whether a and b hold equal BSON values.  The values are
+// compared as they are marshaled rather than by their Go types, so for
+// instance an M and a D holding the same elements are equal.  Raw values
+// are compared as they are.  Values which can't be marshaled, and Raw
+// values holding corrupted data, are not equal to any value.
+//
+// Numbers of the int32, int64 and double kinds are equal when they
+// represent exactly the same number, whatever their kinds, so int32(1),
+// int64(1) and float64(1) are all equal, as done by MongoDB when comparing
+// values, while float64(1.5) isn't equal to any integer.  A NaN double is
+// considered equal to another NaN, so that values holding it may be
+// compared.  Decimal128 values are compared by their exact representation.
+// Values of any other kinds are only equal to values of the same kind.
+//
+// Documents, including the scope of JavaScript code, are equal when they
+// hold the same keys with equal values, in any order.  If a document holds
+// the same key more than once, its last value is the one compared, as done
+// when unmarshaling into maps.  Arrays are equal when they hold equal values
+// in the same order.  Values of other kinds, such as strings, ObjectIds and
+// binary data, are compared byte-wise.
+func Equal(a, b interface{}) (equal bool) {
+	var err os.Error
+	defer func() {
+		if err != nil {
+			equal = false
+		}
+	}()
+	defer handleErr(&err)
+	return rawEqual(marshalRaw(a), marshalRaw(b))
+}
+
+func marshalRaw(in interface{}) Raw {
+	kind, data, err := MarshalValue(in)
+	if err != nil {
+		panic(err)
+	}
+	return Raw{kind, data}
+}
+
+func rawEqual(a, b Raw) bool {
+	if isNumberKind(a.Kind) && isNumberKind(b.Kind) {
+		return numberEqual(a, b)
+	}
+	if a.Kind != b.Kind {
+		return false
+	}
+	switch a.Kind {
+	case KindDocument:
+		return docEqual(a.Data, b.Data)
+	case KindArray:
+		return arrayEqual(a.Data, b.Data)
+	case KindJavaScriptWithScope:
+		da := &decoder{in: a.Data}
+		db := &decoder{in: b.Data}
+		da.readInt32()
+		db.readInt32()
+		if da.readStr() != db.readStr() {
+			return false
+		}
+		return docEqual(a.Data[da.i:], b.Data[db.i:])
+	}
+	return bytes.Equal(a.Data, b.Data)
+}
+
+func isNumberKind(kind byte) bool {
+	return kind == KindDouble || kind == KindInt32 || kind == KindInt64
+}
+
+func numberValue(raw Raw) (i int64, f float64, isFloat bool) {
+	d := &decoder{in: raw.Data}
+	switch raw.Kind {
+	case KindDouble:
+		return 0, d.readFloat64(), true
+	case KindInt32:
+		return int64(d.readInt32()), 0, false
+	}
+	return d.readInt64(), 0, false
+}
+
+func numberEqual(a, b Raw) bool {
+	ia, fa, aFloat := numberValue(a)
+	ib, fb, bFloat := numberValue(b)
+	switch {
+	case aFloat && bFloat:
+		return fa == fb || math.IsNaN(fa) && math.IsNaN(fb)
+	case aFloat:
+		return floatIntEqual(fa, ib)
+	case bFloat:
+		return floatIntEqual(fb, ia)
+	}
+	return ia == ib
+}
+
+// floatIntEqual returns whether f and i represent exactly the same number.
+func floatIntEqual(f float64, i int64) bool {
+	return f >= -(1<<63) && f < 1<<63 && int64(f) == i && float64(i) == f
+}
+
+// rawElems returns the elements of the document in data, in order.
+func rawElems(data []byte) (names []string, elems []Raw) {
+	d := &decoder{in: data}
+	d.readDocWith(func(kind byte, name string) {
+		start := d.i
+		d.validateElem(kind)
+		names = append(names, name)
+		elems = append(elems, Raw{kind, d.in[start:d.i]})
+	})
+	return names, elems
+}
+
+func docEqual(a, b []byte) bool {
+	ma := rawElemMap(a)
+	mb := rawElemMap(b)
+	if len(ma) != len(mb) {
+		return false
+	}
+	for name, elem := range ma {
+		other, ok := mb[name]
+		if !ok || !rawEqual(elem, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func rawElemMap(data []byte) map[string]Raw {
+	names, elems := rawElems(data)
+	m := make(map[string]Raw, len(names))
+	for i, name := range names {
+		m[name] = elems[i]
+	}
+	return m
+}
+
+func arrayEqual(a, b []byte) bool {
+	_, ea := rawElems(a)
+	_, eb := rawElems(b)
+	if len(ea) != len(eb) {
+		return false
+	}
+	for i := range ea {
+		if !rawEqual(ea[i], eb[i]) {
+			return false
+		}
+	}
+	return true
+}
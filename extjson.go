@@ -0,0 +1,689 @@
+// gobson - BSON library for Go.
+//
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bson
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// Rendering of documents as MongoDB Extended JSON.
+
+// ToExtJSON renders the BSON document in as canonical MongoDB Extended
+// JSON.  See the MarshalExtJSON method of Raw for details.
+func ToExtJSON(in []byte) ([]byte, os.Error) {
+	return Raw{KindDocument, in}.MarshalExtJSON()
+}
+
+// MarshalExtJSON renders raw as canonical MongoDB Extended JSON, in the
+// format understood by tools such as mongoexport and mongoimport.  Values
+// which have no direct representation in JSON are wrapped in documents
+// with special keys, such as {"$oid": "..."} for ObjectIds and
+// {"$numberLong": "..."} for int64 values.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/mongodb-extended-json/
+//
+func (raw Raw) MarshalExtJSON() (data []byte, err os.Error) {
+	defer handleErr(&err)
+	kind := raw.Kind
+	if kind == 0x00 {
+		kind = KindDocument
+	}
+	e := &extJSONEncoder{d: &decoder{in: raw.Data}}
+	e.addElem(kind)
+	return e.out, nil
+}
+
+type extJSONEncoder struct {
+	d   *decoder
+	out []byte
+
+	// Whether numbers are rendered as plain JSON numbers when possible,
+	// as done by the relaxed format, rather than wrapped.
+	relaxed bool
+}
+
+func (e *extJSONEncoder) addDoc() {
+	e.addBytes('{')
+	first := true
+	e.d.readDocWith(func(kind byte, name string) {
+		if !first {
+			e.addBytes(',')
+		}
+		first = false
+		e.addStr(name)
+		e.addBytes(':')
+		e.addElem(kind)
+	})
+	e.addBytes('}')
+}
+
+func (e *extJSONEncoder) addArray() {
+	e.addBytes('[')
+	first := true
+	e.d.readDocWith(func(kind byte, name string) {
+		if !first {
+			e.addBytes(',')
+		}
+		first = false
+		e.addElem(kind)
+	})
+	e.addBytes(']')
+}
+
+func (e *extJSONEncoder) addElem(kind byte) {
+	d := e.d
+	switch kind {
+	case KindDouble:
+		f := d.readFloat64()
+		if e.relaxed && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			e.addRaw(formatExtJSONDouble(f))
+		} else {
+			e.addWrapped("$numberDouble", formatExtJSONDouble(f))
+		}
+	case KindString:
+		e.addStr(d.readStr())
+	case KindDocument:
+		e.addDoc()
+	case KindArray:
+		e.addArray()
+	case KindBinary:
+		b := d.readBinary()
+		e.addRaw(`{"$binary":{"base64":"` + base64.StdEncoding.EncodeToString(b.Data) +
+			`","subType":"` + fmt.Sprintf("%02x", b.Kind) + `"}}`)
+	case KindUndefined:
+		e.addRaw(`{"$undefined":true}`)
+	case KindObjectId:
+		e.addRaw(`{"$oid":"` + hex.EncodeToString(d.readBytes(12)) + `"}`)
+	case KindBool:
+		if d.readBool() {
+			e.addRaw("true")
+		} else {
+			e.addRaw("false")
+		}
+	case KindDateTime:
+		e.addRaw(`{"$date":`)
+		e.addWrapped("$numberLong", strconv.Itoa64(d.readInt64()))
+		e.addBytes('}')
+	case KindNull:
+		e.addRaw("null")
+	case KindRegEx:
+		re := d.readRegEx()
+		e.addRaw(`{"$regularExpression":{"pattern":`)
+		e.addStr(re.Pattern)
+		e.addRaw(`,"options":`)
+		e.addStr(re.Options)
+		e.addRaw("}}")
+	case KindDBPointer:
+		e.addRaw(`{"$dbPointer":{"$ref":`)
+		e.addStr(d.readStr())
+		e.addRaw(`,"$id":{"$oid":"` + hex.EncodeToString(d.readBytes(12)) + `"}}}`)
+	case KindJavaScript:
+		e.addRaw(`{"$code":`)
+		e.addStr(d.readStr())
+		e.addBytes('}')
+	case KindSymbol:
+		e.addRaw(`{"$symbol":`)
+		e.addStr(d.readStr())
+		e.addBytes('}')
+	case KindJavaScriptWithScope:
+		start := d.i
+		l := int(d.readInt32())
+		e.addRaw(`{"$code":`)
+		e.addStr(d.readStr())
+		e.addRaw(`,"$scope":`)
+		e.addDoc()
+		e.addBytes('}')
+		if d.i-start != l {
+			corrupted()
+		}
+	case KindInt32:
+		if e.relaxed {
+			e.addRaw(strconv.Itoa(int(d.readInt32())))
+		} else {
+			e.addWrapped("$numberInt", strconv.Itoa(int(d.readInt32())))
+		}
+	case KindMongoTimestamp:
+		ts := uint64(d.readInt64())
+		e.addRaw(`{"$timestamp":{"t":` + strconv.Uitoa64(ts>>32) +
+			`,"i":` + strconv.Uitoa64(ts&0xFFFFFFFF) + `}}`)
+	case KindInt64:
+		if e.relaxed {
+			e.addRaw(strconv.Itoa64(d.readInt64()))
+		} else {
+			e.addWrapped("$numberLong", strconv.Itoa64(d.readInt64()))
+		}
+	case KindDecimal128:
+		dec := Decimal128{l: uint64(d.readInt64()), h: uint64(d.readInt64())}
+		e.addWrapped("$numberDecimal", dec.String())
+	case KindMinKey:
+		e.addRaw(`{"$minKey":1}`)
+	case KindMaxKey:
+		e.addRaw(`{"$maxKey":1}`)
+	default:
+		panic(fmt.Sprintf("Unknown element kind (0x%02X)", kind))
+	}
+}
+
+// formatExtJSONDouble formats f as done for the $numberDouble wrapper,
+// which always includes a decimal point or an exponent for finite values.
+func formatExtJSONDouble(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	s := strconv.Ftoa64(f, 'G', -1)
+	if strings.IndexAny(s, ".E") == -1 {
+		s += ".0"
+	}
+	return s
+}
+
+// addWrapped adds a document with a single key holding a string value.
+func (e *extJSONEncoder) addWrapped(key, value string) {
+	e.addRaw(`{"` + key + `":`)
+	e.addStr(value)
+	e.addBytes('}')
+}
+
+func (e *extJSONEncoder) addRaw(s string) {
+	e.addBytes([]byte(s)...)
+}
+
+func (e *extJSONEncoder) addBytes(v ...byte) {
+	e.out = append(e.out, v...)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// addStr adds s as a quoted JSON string, escaping characters as needed.
+func (e *extJSONEncoder) addStr(s string) {
+	e.addBytes('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"', '\\':
+			e.addBytes('\\', c)
+		case '\n':
+			e.addBytes('\\', 'n')
+		case '\r':
+			e.addBytes('\\', 'r')
+		case '\t':
+			e.addBytes('\\', 't')
+		default:
+			if c < 0x20 {
+				e.addBytes('\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			} else {
+				e.addBytes(c)
+			}
+		}
+	}
+	e.addBytes('"')
+}
+
+// --------------------------------------------------------------------------
+// Parsing of MongoDB Extended JSON documents.
+
+// ParseExtJSON parses the MongoDB Extended JSON document in data, such as
+// a line of the output of mongoexport, and returns the equivalent BSON
+// document.  Both the canonical and the relaxed formats are understood, as
+// well as the legacy forms of the $binary, $date and $regex wrappers.
+// Plain JSON numbers are marshaled as an int32 or an int64 when they are
+// integers that fit, and as a double otherwise.  Documents with a leading
+// key starting with "$" which isn't a known wrapper, such as the $gt query
+// operator, are preserved as regular documents.
+func ParseExtJSON(data []byte) (out []byte, err os.Error) {
+	defer handleErr(&err)
+	p := &extJSONParser{in: data}
+	doc, ok := p.readValue().(D)
+	if !ok {
+		panic("Extended JSON document must be an object")
+	}
+	if p.peek() != 0 {
+		p.syntaxError()
+	}
+	return Marshal(doc)
+}
+
+type extJSONParser struct {
+	in   []byte
+	i    int
+	path []string
+}
+
+func (p *extJSONParser) syntaxError() {
+	panic(fmt.Sprintf("Invalid Extended JSON syntax at offset %d", p.i))
+}
+
+// peek skips any whitespace and returns the next byte in the input
+// without consuming it, or 0 at the end of the input.
+func (p *extJSONParser) peek() byte {
+	for p.i < len(p.in) {
+		switch c := p.in[p.i]; c {
+		case ' ', '\t', '\r', '\n':
+			p.i++
+		default:
+			return c
+		}
+	}
+	return 0
+}
+
+func (p *extJSONParser) expect(c byte) {
+	if p.peek() != c {
+		p.syntaxError()
+	}
+	p.i++
+}
+
+func (p *extJSONParser) readLiteral(lit string) bool {
+	if bytes.HasPrefix(p.in[p.i:], []byte(lit)) {
+		p.i += len(lit)
+		return true
+	}
+	return false
+}
+
+func (p *extJSONParser) readValue() interface{} {
+	switch c := p.peek(); {
+	case c == '{':
+		return p.readObject()
+	case c == '[':
+		return p.readArray()
+	case c == '"':
+		return p.readStr()
+	case c == '-' || c >= '0' && c <= '9':
+		return p.readNumber()
+	case p.readLiteral("true"):
+		return true
+	case p.readLiteral("false"):
+		return false
+	case p.readLiteral("null"):
+		return nil
+	}
+	p.syntaxError()
+	return nil
+}
+
+func (p *extJSONParser) readObject() interface{} {
+	p.expect('{')
+	doc := D{}
+	if p.peek() == '}' {
+		p.i++
+		return doc
+	}
+	for {
+		name := p.readStr()
+		p.expect(':')
+		p.path = append(p.path, name)
+		doc = append(doc, DocElem{name, p.readValue()})
+		p.path = p.path[:len(p.path)-1]
+		if p.peek() != ',' {
+			break
+		}
+		p.i++
+	}
+	p.expect('}')
+	if strings.HasPrefix(doc[0].Name, "$") {
+		return p.readWrapper(doc)
+	}
+	return doc
+}
+
+func (p *extJSONParser) readArray() interface{} {
+	p.expect('[')
+	array := []interface{}{}
+	if p.peek() == ']' {
+		p.i++
+		return array
+	}
+	for {
+		p.path = append(p.path, strconv.Itoa(len(array)))
+		array = append(array, p.readValue())
+		p.path = p.path[:len(p.path)-1]
+		if p.peek() != ',' {
+			break
+		}
+		p.i++
+	}
+	p.expect(']')
+	return array
+}
+
+func (p *extJSONParser) readNumber() interface{} {
+	start := p.i
+	for p.i < len(p.in) && strings.IndexRune("+-0123456789.eE", int(p.in[p.i])) >= 0 {
+		p.i++
+	}
+	s := string(p.in[start:p.i])
+	if strings.IndexAny(s, ".eE") == -1 {
+		i, err := strconv.Atoi64(s)
+		if err == nil {
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				return int32(i)
+			}
+			return i
+		}
+	}
+	f, err := strconv.Atof64(s)
+	if err != nil {
+		p.i = start
+		p.syntaxError()
+	}
+	return f
+}
+
+func (p *extJSONParser) readStr() string {
+	p.expect('"')
+	var b []byte
+	for p.i < len(p.in) {
+		c := p.in[p.i]
+		p.i++
+		switch {
+		case c == '"':
+			return string(b)
+		case c < 0x20:
+			p.i--
+			p.syntaxError()
+		case c != '\\':
+			b = append(b, c)
+		case p.i == len(p.in):
+			p.syntaxError()
+		default:
+			c = p.in[p.i]
+			p.i++
+			switch c {
+			case '"', '\\', '/':
+				b = append(b, c)
+			case 'b':
+				b = append(b, '\b')
+			case 'f':
+				b = append(b, '\f')
+			case 'n':
+				b = append(b, '\n')
+			case 'r':
+				b = append(b, '\r')
+			case 't':
+				b = append(b, '\t')
+			case 'u':
+				r := p.readHex4()
+				if r >= 0xD800 && r < 0xDC00 && p.readLiteral(`\u`) {
+					// UTF-16 surrogate pair.
+					r2 := p.readHex4()
+					if r2 < 0xDC00 || r2 >= 0xE000 {
+						p.syntaxError()
+					}
+					r = (r-0xD800)<<10 | (r2 - 0xDC00) + 0x10000
+				}
+				b = append(b, []byte(string([]int{r}))...)
+			default:
+				p.i--
+				p.syntaxError()
+			}
+		}
+	}
+	p.syntaxError()
+	return ""
+}
+
+func (p *extJSONParser) readHex4() int {
+	if p.i+4 > len(p.in) {
+		p.syntaxError()
+	}
+	r, err := strconv.Btoui64(string(p.in[p.i:p.i+4]), 16)
+	if err != nil {
+		p.syntaxError()
+	}
+	p.i += 4
+	return int(r)
+}
+
+// readWrapper returns the value represented by doc when its keys match
+// one of the Extended JSON wrappers, or doc itself if its leading key
+// isn't known.  Values within doc have already been converted.
+func (p *extJSONParser) readWrapper(doc D) interface{} {
+	key := doc[0].Name
+	switch key {
+	case "$oid":
+		if s, ok := extJSONStr(doc, "$oid"); ok {
+			if id, err := ParseObjectIdHex(s); err == nil {
+				return id
+			}
+		}
+	case "$symbol":
+		if s, ok := extJSONStr(doc, "$symbol"); ok {
+			return Symbol(s)
+		}
+	case "$numberInt":
+		if s, ok := extJSONStr(doc, "$numberInt"); ok {
+			if i, err := strconv.Atoi64(s); err == nil && i >= math.MinInt32 && i <= math.MaxInt32 {
+				return int32(i)
+			}
+		}
+	case "$numberLong":
+		if s, ok := extJSONStr(doc, "$numberLong"); ok {
+			if i, err := strconv.Atoi64(s); err == nil {
+				return Int64(i)
+			}
+		}
+	case "$numberDouble":
+		if s, ok := extJSONStr(doc, "$numberDouble"); ok {
+			switch s {
+			case "NaN":
+				return math.NaN()
+			case "Infinity":
+				return math.Inf(1)
+			case "-Infinity":
+				return math.Inf(-1)
+			}
+			if f, err := strconv.Atof64(s); err == nil {
+				return f
+			}
+		}
+	case "$numberDecimal":
+		if s, ok := extJSONStr(doc, "$numberDecimal"); ok {
+			if dec, err := ParseDecimal128(s); err == nil {
+				return dec
+			}
+		}
+	case "$minKey", "$maxKey":
+		if v, ok := extJSONFields(doc, key); ok {
+			if i, ok := extJSONInt(v[0]); ok && i == 1 {
+				if key == "$minKey" {
+					return MinKey
+				}
+				return MaxKey
+			}
+		}
+	case "$undefined":
+		if v, ok := extJSONFields(doc, "$undefined"); ok && v[0] == true {
+			return Undefined
+		}
+	case "$date":
+		if v, ok := extJSONFields(doc, "$date"); ok {
+			if s, ok := v[0].(string); ok {
+				if t, err := time.Parse(time.RFC3339, s); err == nil {
+					return t
+				}
+			} else if ms, ok := extJSONInt(v[0]); ok {
+				return msToTime(ms)
+			}
+		}
+	case "$binary":
+		var data, subtype string
+		var ok bool
+		if v, isDoc := doc[0].Value.(D); isDoc {
+			// Canonical form: {"$binary": {"base64": ..., "subType": ...}}
+			var fields []interface{}
+			if fields, ok = extJSONFields(v, "base64", "subType"); ok && len(doc) == 1 {
+				data, ok = fields[0].(string)
+				subtype, _ = fields[1].(string)
+			}
+		} else if fields, isLegacy := extJSONFields(doc, "$binary", "$type"); isLegacy {
+			data, ok = fields[0].(string)
+			subtype, _ = fields[1].(string)
+		}
+		if ok {
+			b, err1 := base64.StdEncoding.DecodeString(data)
+			kind, err2 := strconv.Btoui64(subtype, 16)
+			if err1 == nil && err2 == nil && len(subtype) <= 2 {
+				return Binary{byte(kind), b}
+			}
+		}
+	case "$regularExpression":
+		if v, ok := extJSONFields(doc, "$regularExpression"); ok {
+			if re, ok := v[0].(D); ok {
+				if fields, ok := extJSONFields(re, "pattern", "options"); ok {
+					pattern, ok1 := fields[0].(string)
+					options, ok2 := fields[1].(string)
+					if ok1 && ok2 {
+						return RegEx{pattern, options}
+					}
+				}
+			}
+		}
+	case "$regex":
+		// The legacy form is also the syntax of the $regex query
+		// operator, which may hold other values.
+		if pattern, ok := extJSONStr(doc, "$regex"); ok {
+			return RegEx{pattern, ""}
+		}
+		if fields, ok := extJSONFields(doc, "$regex", "$options"); ok {
+			pattern, ok1 := fields[0].(string)
+			options, ok2 := fields[1].(string)
+			if ok1 && ok2 {
+				return RegEx{pattern, options}
+			}
+		}
+		return doc
+	case "$code":
+		if code, ok := extJSONStr(doc, "$code"); ok {
+			return JS{code, nil}
+		}
+		if fields, ok := extJSONFields(doc, "$code", "$scope"); ok {
+			code, ok1 := fields[0].(string)
+			scope, ok2 := fields[1].(D)
+			if ok1 && ok2 {
+				return JS{code, scope}
+			}
+		}
+	case "$timestamp":
+		if v, ok := extJSONFields(doc, "$timestamp"); ok {
+			if ts, ok := v[0].(D); ok {
+				if fields, ok := extJSONFields(ts, "t", "i"); ok {
+					t, ok1 := extJSONInt(fields[0])
+					i, ok2 := extJSONInt(fields[1])
+					if ok1 && ok2 && t >= 0 && t <= math.MaxUint32 && i >= 0 && i <= math.MaxUint32 {
+						return MongoTimestamp(t<<32 | i)
+					}
+				}
+			}
+		}
+	case "$dbPointer":
+		if v, ok := extJSONFields(doc, "$dbPointer"); ok {
+			if ptr, ok := v[0].(D); ok {
+				if fields, ok := extJSONFields(ptr, "$ref", "$id"); ok {
+					ns, ok1 := fields[0].(string)
+					id, ok2 := fields[1].(ObjectId)
+					if ok1 && ok2 {
+						return DBPointer{ns, id}
+					}
+				}
+			}
+		}
+	default:
+		return doc
+	}
+	panic(fmt.Sprintf("Invalid Extended JSON %s wrapper at key %q", key, strings.Join(p.path, ".")))
+}
+
+// extJSONFields returns the values of the named keys in doc, in the
+// order provided, if doc holds exactly these keys in any order.
+func extJSONFields(doc D, names ...string) (values []interface{}, ok bool) {
+	if len(doc) != len(names) {
+		return nil, false
+	}
+	values = make([]interface{}, len(names))
+	seen := make([]bool, len(names))
+	for _, elem := range doc {
+		found := false
+		for i, name := range names {
+			if elem.Name == name && !seen[i] {
+				values[i] = elem.Value
+				seen[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// extJSONStr returns the string value of the only key in doc, if it's
+// named as provided.
+func extJSONStr(doc D, name string) (s string, ok bool) {
+	if values, ok := extJSONFields(doc, name); ok {
+		s, ok = values[0].(string)
+		return s, ok
+	}
+	return "", false
+}
+
+// extJSONInt returns the integer held by v, which may be a plain JSON
+// number or a $numberInt or $numberLong wrapper.
+func extJSONInt(v interface{}) (i int64, ok bool) {
+	switch v := v.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case Int64:
+		return int64(v), true
+	}
+	return 0, false
+}
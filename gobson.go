@@ -34,14 +34,18 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"crypto/md5"
+	"crypto/rand"
 	"runtime"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"sync"
 	"time"
 	"fmt"
+	"io"
 	"os"
+	"unsafe"
 )
 
 // --------------------------------------------------------------------------
@@ -63,6 +67,119 @@ type Setter interface {
 	SetBSON(v interface{}) (ok bool)
 }
 
+// GetterError is similar to Getter, but allows the GetBSON method to
+// report a failure.  If an error is returned, marshaling is aborted and
+// the error is returned to the caller.  Since both interfaces share the
+// GetBSON method name, a type implements at most one of them, and the
+// signature of its GetBSON method decides which one applies.
+type GetterError interface {
+	GetBSON() (interface{}, os.Error)
+}
+
+// SetterError is similar to Setter, but allows the SetBSON method to
+// report a failure.  If an error is returned, unmarshaling is aborted and
+// the error is returned to the caller.  Since both interfaces share the
+// SetBSON method name, a type implements at most one of them, and the
+// signature of its SetBSON method decides which one applies.
+type SetterError interface {
+	SetBSON(v interface{}) os.Error
+}
+
+// RawSetter is similar to SetterError, but the SetBSON method receives
+// the element as a Raw value, without it being unmarshaled beforehand.
+// This allows implementations to decide which parts of the data to
+// unmarshal, if any.  The Data field of the Raw value references the data
+// being unmarshaled, so it must be copied if the input may be modified
+// while it's retained.  It shares the SetBSON method name with Setter and
+// SetterError, so the signature of that method decides which of the three
+// interfaces a type implements.
+type RawSetter interface {
+	SetBSON(raw Raw) os.Error
+}
+
+// Objects implementing the bson.Marshaler interface will get the
+// MarshalBSON method called when the given value has to be marshaled, and
+// the complete BSON document it returns will be used in place of the
+// actual object.  This follows the convention used by other BSON packages,
+// easing the reuse of types written for them, and is preferred over the
+// Getter and GetterError interfaces when more than one could apply.
+type Marshaler interface {
+	MarshalBSON() ([]byte, os.Error)
+}
+
+// Objects implementing the bson.Unmarshaler interface will receive the
+// complete BSON document being unmarshaled into them via the UnmarshalBSON
+// method, and will not be changed as usual.  If an error is returned,
+// unmarshaling is aborted and the error is returned to the caller.  The
+// data references the document being unmarshaled, so it must be copied if
+// the input may be modified while it's retained.  This interface is
+// preferred over the Setter interfaces when more than one could apply,
+// and is only considered for embedded documents.
+type Unmarshaler interface {
+	UnmarshalBSON(data []byte) os.Error
+}
+
+type codec struct {
+	enc func(v reflect.Value) (kind byte, data []byte)
+	dec func(kind byte, data []byte, v reflect.Value) bool
+}
+
+// The registered codecs, as a *codecMap which is never modified once
+// stored, so that lookups don't need any locking.  Registering a codec
+// stores a modified copy of the map instead, with codecsMutex held.
+var codecs unsafe.Pointer
+var codecsMutex sync.Mutex
+
+type codecMap map[reflect.Type]codec
+
+// RegisterCodec registers custom marshaling and unmarshaling logic for
+// values of type t, which is consulted before any other handling of such
+// values, including the Getter and Setter interfaces.  This allows types
+// which can't be modified, such as types from other packages, to be
+// handled in a particular way.
+//
+// When marshaling a value of type t, or a non-nil pointer to one, enc is
+// called with the value and must return the element kind and data to be
+// used for it, in the format of the Kind and Data fields of Raw.  When
+// unmarshaling an element into a value of type t, or into a pointer to
+// one, dec is called with the element kind and data and with the settable
+// value to unmarshal into, and must return whether the element could be
+// unmarshaled.  Elements for which dec returns false are skipped as done
+// for incompatible values.  To abort the process, enc and dec may panic
+// with an os.Error, which is returned to the caller.  Either function may
+// be nil, in which case values of type t are processed as usual in that
+// direction, and registering two nil functions removes the codec for t.
+//
+// RegisterCodec may be called concurrently with marshaling and
+// unmarshaling, but values being processed at the same time may or may
+// not observe the new codec, so codecs are best registered during the
+// initialization of the program.  Registering a codec copies the whole
+// set of codecs, so that looking them up while marshaling and unmarshaling
+// needs no locking.
+func RegisterCodec(t reflect.Type, enc func(v reflect.Value) (kind byte, data []byte), dec func(kind byte, data []byte, v reflect.Value) bool) {
+	codecsMutex.Lock()
+	m := make(codecMap)
+	if old := (*codecMap)(atomic.LoadPointer(&codecs)); old != nil {
+		for k, v := range *old {
+			m[k] = v
+		}
+	}
+	if enc == nil && dec == nil {
+		m[t] = codec{}, false
+	} else {
+		m[t] = codec{enc, dec}
+	}
+	atomic.StorePointer(&codecs, unsafe.Pointer(&m))
+	codecsMutex.Unlock()
+}
+
+func lookupCodec(t reflect.Type) (c codec, found bool) {
+	if m := (*codecMap)(atomic.LoadPointer(&codecs)); m != nil {
+		c, found = (*m)[t]
+	}
+	return c, found
+}
+
 // Handy alias for a map[string]interface{} map, useful for dealing with BSON
 // in a native way.  For instance:
 //
@@ -90,11 +207,46 @@ type DocElem struct {
 	Value interface{}
 }
 
+// NewD returns a D holding the provided elements, which must be given
+// as alternating name and value pairs.  For instance:
+//
+//     bson.NewD("a", 1, "b", true)
+//
+// NewD panics if an odd number of arguments is provided, or if any of
+// the names is not a string.
+func NewD(pairs ...interface{}) D {
+	if len(pairs)%2 != 0 {
+		panic("NewD needs name/value pairs, got an odd number of arguments")
+	}
+	d := make(D, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		name, ok := pairs[i].(string)
+		if !ok {
+			panic(fmt.Sprintf("NewD needs string names, got %#v at position %d", pairs[i], i))
+		}
+		d = append(d, DocElem{name, pairs[i+1]})
+	}
+	return d
+}
+
+// Append returns d with a new element holding the provided name and
+// value added at its end.  As with the append builtin, the result must
+// be used in place of d.
+func (d D) Append(name string, value interface{}) D {
+	return append(d, DocElem{name, value})
+}
+
 // Raw may be used to work with raw unprocessed BSON documents and elements,
 // if necessary in advanced cases.  Kind is the kind of element as defined
 // per the BSON specification, and Data is the raw unprocessed data for
 // the respective element.
 //
+// Elements unmarshaled into a Raw value, such as a struct field or the
+// values of a map[string]Raw map, are only validated and not otherwise
+// unmarshaled, so that their decoding may be done later on demand, if at
+// all.  Nested documents and arrays are held with kinds 0x03 and 0x04,
+// and the Data field references the data being unmarshaled.
+//
 // Relevant documentation:
 //
 //     http://bsonspec.org/#/specification
@@ -104,6 +256,32 @@ type Raw struct {
 	Data []byte
 }
 
+// Kinds of elements as defined per the BSON specification.  These may be
+// compared against the Kind field of Raw values.
+const (
+	KindDouble              byte = 0x01
+	KindString              byte = 0x02
+	KindDocument            byte = 0x03
+	KindArray               byte = 0x04
+	KindBinary              byte = 0x05
+	KindUndefined           byte = 0x06
+	KindObjectId            byte = 0x07
+	KindBool                byte = 0x08
+	KindDateTime            byte = 0x09
+	KindNull                byte = 0x0A
+	KindRegEx               byte = 0x0B
+	KindDBPointer           byte = 0x0C
+	KindJavaScript          byte = 0x0D
+	KindSymbol              byte = 0x0E
+	KindJavaScriptWithScope byte = 0x0F
+	KindInt32               byte = 0x10
+	KindMongoTimestamp      byte = 0x11
+	KindInt64               byte = 0x12
+	KindDecimal128          byte = 0x13
+	KindMaxKey              byte = 0x7F
+	KindMinKey              byte = 0xFF
+)
+
 // Build a map[string]interface{} out of the ordered element name/value pairs.
 func (d D) Map() (m M) {
 	m = make(M, len(d))
@@ -113,6 +291,30 @@ func (d D) Map() (m M) {
 	return m
 }
 
+// RawD represents a BSON document as an ordered list of its elements in
+// raw form, so that the elements may be inspected, filtered or reordered
+// without unmarshaling their values.  Documents unmarshaled into a RawD
+// value preserve all of their elements in the order they are found, and
+// the Value of each element references the data being unmarshaled.
+// Marshaling a RawD value produces a document with the same elements.
+type RawD []RawDocElem
+
+// See the bson.RawD type.
+type RawDocElem struct {
+	Name  string
+	Value Raw
+}
+
+// Map builds a map out of the ordered raw elements.  If the same name is
+// found more than once, the last element wins.
+func (d RawD) Map() (m map[string]Raw) {
+	m = make(map[string]Raw, len(d))
+	for _, item := range d {
+		m[item.Name] = item.Value
+	}
+	return m
+}
+
 // Unique ID identifying the BSON object. Must be exactly 12 bytes long.
 // MongoDB objects by default have such a property set in their "_id"
 // property.
@@ -121,65 +323,187 @@ func (d D) Map() (m M) {
 type ObjectId string
 
 // ObjectIdHex returns an ObjectId from the provided hex representation.
-// Calling this function with an invalid hex representation will
-// cause a runtime panic.
+// It calls ParseObjectIdHex, and calling it with an invalid hex
+// representation will cause a runtime panic.
+//
+// The hex representation may use uppercase or mixed case digits, but the
+// canonical form of an id, as returned by its ToString method, is always
+// lowercase.  Ids parsed from different spellings of the same digits are
+// therefore equal and stringify identically.
 func ObjectIdHex(s string) ObjectId {
+	id, err := ParseObjectIdHex(s)
+	if err != nil {
+		panic(err.String())
+	}
+	return id
+}
+
+// ParseObjectIdHex returns an ObjectId from the provided hex representation.
+// Unlike ObjectIdHex, an error is returned if s isn't a valid hex
+// representation of exactly 12 bytes, which makes it suitable for parsing
+// ids from untrusted input.
+func ParseObjectIdHex(s string) (ObjectId, os.Error) {
 	d, err := hex.DecodeString(s)
 	if err != nil || len(d) != 12 {
-		panic(fmt.Sprintf("Invalid input to ObjectIdHex: %q", s))
+		return "", os.NewError(fmt.Sprintf("Invalid input to ObjectIdHex: %q", s))
+	}
+	return ObjectId(d), nil
+}
+
+// NormalizeObjectIdHex returns the canonical lowercase form of the hex
+// representation s, which may use any case.  An error is returned if s
+// isn't a valid hex representation of an ObjectId.
+func NormalizeObjectIdHex(s string) (string, os.Error) {
+	id, err := ParseObjectIdHex(s)
+	if err != nil {
+		return "", err
+	}
+	return id.Hex(), nil
+}
+
+// IsObjectIdHex returns whether s is a valid hex representation of
+// an ObjectId. See the ObjectIdHex function.
+func IsObjectIdHex(s string) bool {
+	if len(s) != 24 {
+		return false
+	}
+	for i := 0; i != len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
 	}
-	return ObjectId(d)
+	return true
 }
 
+// timeNow returns the current time.  It's used by NewObjectId, NewObjectIdWith
+// and Now, and may be replaced in tests to make their results predictable.
+var timeNow = time.Now
+
 // objectIdCounter is atomically incremented when generating a new ObjectId
 // using NewObjectId() function. It's used as a counter part of an id.
-var objectIdCounter uint32 = 0
+// It starts at a random value, so that processes restarted within the
+// same second are unlikely to generate the same ids.
+var objectIdCounter uint32 = readRandomUint32()
+
+// readRandomUint32 returns a random uint32 value, falling back to the
+// current time if the system source of randomness can't be read.
+func readRandomUint32() uint32 {
+	var b [4]byte
+	_, err := io.ReadFull(rand.Reader, b[:])
+	if err != nil {
+		return uint32(time.Nanoseconds())
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
 
 // machineId stores machine id generated once and used in subsequent calls
-// to NewObjectId function.
+// to NewObjectId function.  It's only read when first needed, so that the
+// hostname isn't looked up unless NewObjectId is used.
 var machineId []byte
+var machineIdOnce sync.Once
 
-// initMachineId generates machine id and puts it into the machineId global
-// variable. If this function fails to get the hostname, it will cause
-// a runtime error.
-func initMachineId() {
+func getMachineId() []byte {
+	machineIdOnce.Do(func() {
+		if machineId == nil {
+			machineId = readMachineId()
+		}
+	})
+	return machineId
+}
+
+// readMachineId returns the first 3 bytes of the md5 sum of the hostname.
+// If the hostname can't be obtained, 3 random bytes are used instead.
+func readMachineId() []byte {
 	var sum [3]byte
 	hostname, err := os.Hostname()
 	if err != nil {
-		panic("Failed to get hostname: " + err.String())
+		r := readRandomUint32()
+		sum[0], sum[1], sum[2] = byte(r>>16), byte(r>>8), byte(r)
+		return sum[:]
 	}
 	hw := md5.New()
 	hw.Write([]byte(hostname))
 	copy(sum[:3], hw.Sum())
-	machineId = sum[:]
+	return sum[:]
+}
+
+// SetMachineId defines the 3 bytes used as the machine part of ids
+// generated by NewObjectId, replacing the value derived by default from
+// the hostname.  This is useful in environments where the hostname is
+// not meaningful or stable.  It must be called before any ids are
+// generated, and panics if id is not exactly 3 bytes long.
+func SetMachineId(id []byte) {
+	if len(id) != 3 {
+		panic(fmt.Sprintf("Machine id must be exactly 3 bytes long (got %d)", len(id)))
+	}
+	machineId = []byte{id[0], id[1], id[2]}
 }
 
-// NewObjectId generates and returns a new unique ObjectId.
-// This function causes a runtime error if it fails to get the hostname
-// of the current machine.
+// NewObjectId generates and returns a new unique ObjectId.  Only the lowest
+// 3 bytes of the internal counter are used in the id, so the counter part
+// wraps around to zero after reaching 0xFFFFFF.
 func NewObjectId() ObjectId {
+	// Machine, first 3 bytes of md5(hostname), or random if unavailable
+	machine := getMachineId()
+	return NewObjectIdWith(machine, uint16(os.Getpid()), atomic.AddUint32(&objectIdCounter, 1))
+}
+
+// NewObjectIdWith returns a new ObjectId with the timestamp part taken from
+// the current time, and the machine, process id and counter parts set to
+// the provided values, rather than derived from the hostname, the current
+// process, and the internal counter as done by NewObjectId.  This is useful
+// for deterministic tests, and in environments where the hostname can't be
+// obtained.  Only the lowest 3 bytes of counter are used, and the function
+// panics if machine is not exactly 3 bytes long.
+func NewObjectIdWith(machine []byte, pid uint16, counter uint32) ObjectId {
+	if len(machine) != 3 {
+		panic(fmt.Sprintf("Machine id must be exactly 3 bytes long (got %d)", len(machine)))
+	}
 	b := make([]byte, 12)
 	// Timestamp, 4 bytes, big endian
-	binary.BigEndian.PutUint32(b, uint32(time.Seconds()))
-	// Machine, first 3 bytes of md5(hostname)
-	if machineId == nil {
-		initMachineId()
-	}
-	b[4] = machineId[0]
-	b[5] = machineId[1]
-	b[6] = machineId[2]
+	binary.BigEndian.PutUint32(b, uint32(timeNow().Unix()))
+	// Machine, 3 bytes
+	b[4] = machine[0]
+	b[5] = machine[1]
+	b[6] = machine[2]
 	// Pid, 2 bytes, specs don't specify endianness, but we use big endian.
-	pid := os.Getpid()
 	b[7] = byte(pid >> 8)
 	b[8] = byte(pid)
 	// Increment, 3 bytes, big endian
-	i := atomic.AddUint32(&objectIdCounter, 1)
-	b[9] = byte(i >> 16)
-	b[10] = byte(i >> 8)
-	b[11] = byte(i)
+	b[9] = byte(counter >> 16)
+	b[10] = byte(counter >> 8)
+	b[11] = byte(counter)
 	return ObjectId(b)
 }
 
+// NewObjectIds generates and returns n new unique ObjectIds at once, which
+// is cheaper than calling NewObjectId n times.  A range of n values of the
+// internal counter is reserved with a single atomic operation, and all the
+// ids share the same timestamp, machine and process id parts, so they are
+// sorted in ascending order unless the 3 bytes of the counter part wrap
+// around to zero in the middle of the batch.  It panics if n is negative
+// or larger than the 1<<24 values the counter part may hold.
+func NewObjectIds(n int) []ObjectId {
+	if n < 0 || n > 1<<24 {
+		panic(fmt.Sprintf("Can't generate %d ObjectIds in a single batch", n))
+	}
+	ids := make([]ObjectId, n)
+	if n == 0 {
+		return ids
+	}
+	counter := atomic.AddUint32(&objectIdCounter, uint32(n)) - uint32(n) + 1
+	b := []byte(NewObjectIdWith(getMachineId(), uint16(os.Getpid()), 0))
+	for i := range ids {
+		b[9] = byte(counter >> 16)
+		b[10] = byte(counter >> 8)
+		b[11] = byte(counter)
+		ids[i] = ObjectId(b)
+		counter++
+	}
+	return ids
+}
+
 // NewObjectIdSeconds returns a dummy ObjectId with the timestamp part filled
 // with the provided number of seconds from epoch UTC, and all other parts
 // filled with zeroes. It's not safe to insert a document with an id generated
@@ -191,10 +515,30 @@ func NewObjectIdSeconds(sec int32) ObjectId {
 	return ObjectId(string(b[:]))
 }
 
-// String returns a hex string representation of the id.
-// Example: ObjectIdHex("4d88e15b60f486e428412dc9").
+// NewObjectIdFromTime returns a dummy ObjectId with the timestamp part
+// filled with the seconds of t since epoch, and all other parts filled with
+// zeroes.  As with NewObjectIdSeconds, it's not safe to insert a document
+// with an id generated by this method, it is useful only for queries to find
+// documents with ids generated before or after the specified time.
+func NewObjectIdFromTime(t time.Time) ObjectId {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()))
+	return ObjectId(string(b[:]))
+}
+
+// String returns a hex string representation of the id, using lowercase
+// hex digits, wrapped so that it's easily recognized when debugging.
+// Example: ObjectIdHex("4d88e15b60f486e428412dc9").  See the Hex method
+// for the bare hex representation.
 func (id ObjectId) String() string {
-	return `ObjectIdHex("` + hex.EncodeToString([]byte(string(id))) + `")`
+	return `ObjectIdHex("` + id.Hex() + `")`
+}
+
+// Hex returns the canonical hex representation of the id, using lowercase
+// hex digits.  Example: "4d88e15b60f486e428412dc9".  The result may be
+// turned back into the id with ObjectIdHex.
+func (id ObjectId) Hex() string {
+	return hex.EncodeToString([]byte(string(id)))
 }
 
 // Valid returns true if the id is valid (contains exactly 12 bytes)
@@ -202,6 +546,15 @@ func (id ObjectId) Valid() bool {
 	return len(id) == 12
 }
 
+// ZeroObjectId is the ObjectId with all of its 12 bytes set to zero.
+const ZeroObjectId = ObjectId("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+
+// IsZero returns true if id is empty or has all of its 12 bytes set to
+// zero, which is the case for ids that were never set.
+func (id ObjectId) IsZero() bool {
+	return id == "" || id == ZeroObjectId
+}
+
 // byteSlice returns byte slice of id from start to end.
 // Calling this function with an invalid id will cause a runtime panic.
 func (id ObjectId) byteSlice(start, end int) []byte {
@@ -239,13 +592,77 @@ func (id ObjectId) Counter() int32 {
 	return int32(uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]))
 }
 
+// Compare compares the raw bytes of id and other lexicographically,
+// returning -1, 0, or +1 if id is respectively less than, equal to, or
+// greater than other.  Since ids start with their creation timestamp,
+// this orders them chronologically.  Ids of invalid length are compared
+// byte by byte as well, so a shorter id that is a prefix of a longer one
+// is considered less than it.
+func (id ObjectId) Compare(other ObjectId) int {
+	switch {
+	case id < other:
+		return -1
+	case id > other:
+		return 1
+	}
+	return 0
+}
+
+// Before returns true if id sorts before other. See the Compare method.
+func (id ObjectId) Before(other ObjectId) bool {
+	return id < other
+}
+
+// Equal returns true if id and other are both valid and hold the same
+// 12 bytes.  Unlike the == operator, it returns false when either id has
+// an invalid length, even if both are equal.  The comparison is a plain
+// byte comparison which is not done in constant time, so it's not suitable
+// for comparing secrets.
+func (id ObjectId) Equal(other ObjectId) bool {
+	return id.Valid() && other.Valid() && id == other
+}
+
+// ToString returns the canonical hex representation of the id, like Hex.
+//
+// Deprecated: use Hex instead.
 func (id ObjectId) ToString() string {
-	return hex.EncodeToString([]byte(string(id)))
+	return id.Hex()
+}
+
+// MarshalJSON turns a bson.ObjectId into a json.Marshaler, rendering
+// the id as a quoted hex string such as "4d88e15b60f486e428412dc9".
+func (id ObjectId) MarshalJSON() ([]byte, os.Error) {
+	return []byte(`"` + id.Hex() + `"`), nil
+}
+
+// UnmarshalJSON turns *bson.ObjectId into a json.Unmarshaler. It accepts
+// the quoted hex representation generated by MarshalJSON, and resets the
+// id when given null or an empty string.  Unlike ObjectIdHex, an invalid
+// representation results in an error rather than a runtime panic.
+func (id *ObjectId) UnmarshalJSON(data []byte) os.Error {
+	s := string(data)
+	if s == "null" || s == `""` {
+		*id = ""
+		return nil
+	}
+	if len(s) != 26 || s[0] != '"' || s[25] != '"' {
+		return os.NewError(fmt.Sprintf("Invalid ObjectId in JSON: %s", s))
+	}
+	d, err := hex.DecodeString(s[1:25])
+	if err != nil {
+		return os.NewError(fmt.Sprintf("Invalid ObjectId in JSON: %s (%s)", s, err.String()))
+	}
+	*id = ObjectId(d)
+	return nil
 }
 
 // Similar to a string, but used in languages with a distinct symbol type. This
 // is an alias to a string type, so it can be used in string contexts and
 // string(symbol) will work correctly.
+//
+// Symbol values are unmarshaled into string and Symbol targets alike, and
+// into interface values such as the ones in M as a Symbol, so that they
+// are marshaled back as symbols.
 type Symbol string
 
 // UTC timestamp defined as nanoseconds since the traditional epoch time.  The
@@ -253,29 +670,66 @@ type Symbol string
 // precision will be lost when sending a Go value to MongoDB, but given that
 // Go most commonly uses nanoseconds in time-related operations, this conversion
 // is convenient.
+//
+// Values of type time.Time are also supported, and are marshaled into the
+// same UTC datetime BSON type with the same millisecond precision.  Such
+// values are unmarshaled back in UTC, and the zero time.Time is special-cased
+// so that it survives a roundtrip unchanged.
 type Timestamp int64
 
 // Now returns a Timestamp value with the current time in nanoseconds.
 func Now() Timestamp {
 	// The value is stored in MongoDB as milliseconds, so truncate the value
 	// ahead of time to avoid surprises after a roundtrip.
-	return Timestamp(time.Nanoseconds() / 1e6 * 1e6)
+	return Timestamp(timeNow().UnixNano() / 1e6 * 1e6)
+}
+
+// zeroTimeMs is the number of milliseconds from epoch to the zero time.Time.
+const zeroTimeMs = -62135596800000
+
+// timeToMs returns the number of milliseconds from epoch until t,
+// truncating any sub-millisecond precision.
+func timeToMs(t time.Time) int64 {
+	t = t.UTC()
+	return t.Unix()*1e3 + int64(t.Nanosecond()/1e6)
+}
+
+// msToTime returns the UTC time.Time which is ms milliseconds from epoch.
+func msToTime(ms int64) time.Time {
+	if ms == zeroTimeMs {
+		return time.Time{}
+	}
+	return time.Unix(ms/1e3, ms%1e3*1e6).UTC()
 }
 
+// Integer type which is always marshaled as a BSON int64, irrespective of
+// its value and of the "/s" field flag.  Plain integer types are marshaled
+// as an int32 or an int64 depending on their width, so this may be used for
+// enforcing a stable schema across platforms with a different int size.
+type Int64 int64
+
 // Special internal type used by MongoDB which for some strange reason has its
 // own datatype defined in BSON.
 type MongoTimestamp int64
 
-type orderKey int64
+// OrderKey is the type of the MinKey and MaxKey special values.  These are
+// the only meaningful values of the type, and are also what unmarshaling
+// the respective BSON kinds produces, so they may be compared against or
+// type-switched on when inspecting unmarshaled documents.
+type OrderKey int64
 
 // Special value which compares higher than all other possible BSON values.
-var MaxKey = orderKey(1<<63 - 1)
+var MaxKey = OrderKey(1<<63 - 1)
 
 // Special value which compares lower than all other possible BSON values.
-var MinKey = orderKey(-1 << 63)
+var MinKey = OrderKey(-1 << 63)
 
 type undefined struct{}
 
+// Undefined represents the obsolete BSON undefined value (kind 0x06), which
+// is still found in legacy documents.  It's marshaled as such, and the
+// undefined value is unmarshaled into interface values, including the
+// ones in M and D, as Undefined, so that it survives a round trip.
 var Undefined undefined
 
 // Representation for non-standard binary values.  Any kind should work,
@@ -284,7 +738,8 @@ var Undefined undefined
 //   0x00 - Generic. This is decoded as []byte(data), not Binary{0x00, data}.
 //   0x01 - Function (!?)
 //   0x02 - Obsolete generic.
-//   0x03 - UUID
+//   0x03 - UUID (legacy)
+//   0x04 - UUID
 //   0x05 - MD5
 //   0x80 - User defined.
 //
@@ -293,19 +748,65 @@ type Binary struct {
 	Data []byte
 }
 
+// NewBinaryUUID returns a Binary value holding the provided UUID with
+// the standard 0x04 subtype.
+func NewBinaryUUID(uuid [16]byte) Binary {
+	return Binary{Kind: 0x04, Data: uuid[:]}
+}
+
+// UUID returns the UUID held by the binary value. An error is returned
+// if the binary subtype is not 0x03 or 0x04, or if the data is not
+// exactly 16 bytes long.
+func (b Binary) UUID() (uuid [16]byte, err os.Error) {
+	if b.Kind != 0x03 && b.Kind != 0x04 {
+		return uuid, os.NewError(fmt.Sprintf("Binary subtype 0x%02x is not a UUID", b.Kind))
+	}
+	if len(b.Data) != 16 {
+		return uuid, os.NewError(fmt.Sprintf("Binary UUID has %d bytes rather than 16", len(b.Data)))
+	}
+	copy(uuid[:], b.Data)
+	return uuid, nil
+}
+
+// DBPointer refers to a document by the namespace of its collection and
+// its id.  It's a deprecated BSON type, supported so that existing data
+// holding it may be handled without losses.
+type DBPointer struct {
+	Namespace string
+	Id        ObjectId
+}
+
+// UUID holds a universally unique identifier.  It is marshaled as binary
+// data with the standard 0x04 UUID subtype, rather than with the generic
+// 0x00 subtype used for other byte arrays.  Binary data with either the
+// 0x03 or 0x04 subtypes may be unmarshaled into it.
+type UUID [16]byte
+
 // A special type for regular expressions.  The Options field should contain
 // individual characters defining the way in which the pattern should be
 // applied, and must be sorted. Valid options as of this writing are 'i' for
 // case insensitive matching, 'm' for multi-line matching, 'x' for verbose
 // mode, 'l' to make \w, \W, and similar be locale-dependent, 's' for dot-all
 // mode (a '.' matches everything), and 'u' to make \w, \W, and similar match
-// unicode. The value of the Options parameter is not verified before being
-// marshaled into the BSON format.
+// unicode. The Options are sorted when marshaled into the BSON format, and
+// marshaling fails if an unknown option is found.
 type RegEx struct {
 	Pattern string
 	Options string
 }
 
+// Normalize returns a copy of re with its options sorted, as expected by
+// MongoDB.  The options are not otherwise verified.
+func (re RegEx) Normalize() RegEx {
+	opts := []byte(re.Options)
+	for i := 1; i < len(opts); i++ {
+		for j := i; j > 0 && opts[j] < opts[j-1]; j-- {
+			opts[j], opts[j-1] = opts[j-1], opts[j]
+		}
+	}
+	return RegEx{re.Pattern, string(opts)}
+}
+
 // Special type for JavaScript code.  If Scope is non-nil, it will be marshaled
 // as a mapping from identifiers to values which should be used when evaluating
 // the provided Code.
@@ -315,20 +816,38 @@ type JS struct {
 }
 
 
+// MaxDocumentSize is the maximum size in bytes of a document, or of any
+// document nested within it, accepted when unmarshaling.  Data declaring
+// a larger length is rejected with an error, which protects against
+// corrupted or malicious input.  It defaults to 16MB, which is the maximum
+// document size accepted by MongoDB.
+var MaxDocumentSize = 16 * 1024 * 1024
+
+// MaxDocumentDepth is the maximum number of documents and arrays nested
+// within each other, including the outer document, accepted when
+// unmarshaling or validating data.  Deeper data is rejected with an error
+// rather than risking the exhaustion of the stack by malicious input.
+var MaxDocumentDepth = 100
+
 const initialBufferSize = 64
 
 func handleErr(err *os.Error) {
 	if r := recover(); r != nil {
-		if _, ok := r.(runtime.Error); ok {
-			panic(r)
-		} else if s, ok := r.(string); ok {
-			*err = os.ErrorString(s)
-		} else if e, ok := r.(os.Error); ok {
-			*err = e
-		} else {
-			panic(r)
-		}
+		*err = panicErr(r)
+	}
+}
+
+// panicErr returns the error held by the r value recovered from a panic.
+// Runtime errors and unknown values are panicked again.
+func panicErr(r interface{}) os.Error {
+	if _, ok := r.(runtime.Error); ok {
+		panic(r)
+	} else if s, ok := r.(string); ok {
+		return os.ErrorString(s)
+	} else if e, ok := r.(os.Error); ok {
+		return e
 	}
+	panic(r)
 }
 
 
@@ -336,34 +855,478 @@ func handleErr(err *os.Error) {
 // In the case of struct values, only exported fields will be serialized.
 // These fields may optionally have tags to define the serialization key for
 // the respective fields.  Without a tag, the lowercased field name is used
-// as the key for each field.  If a field tag ends in "/c", that field will
+// as the key for each field, unless a different function was set via
+// SetDefaultKeyFunc.  If a field tag ends in "/c", that field will
 // only be serialized if it's not set to the zero value for the field type.
 // If a field tag ends with the "/s" suffix, an int64 value in the given
 // field will be serialized as an int32 if possible.
+//
+// Alternatively, flags may follow the key separated by commas, in the same
+// fashion as done by the json package.  The "omitempty" flag is equivalent
+// to the "/c" suffix, so the tag "name,omitempty" is the same as "name/c",
+// and the "minsize" flag is equivalent to the "/s" suffix.  If the key
+// before the comma is empty, as in ",omitempty", the default key for the
+// field is used while the flags are still honored.  Fields tagged with "-"
+// are never marshaled nor unmarshaled.  The "inline" flag may be used on a
+// struct value field to have its own fields processed as if they were part
+// of the outer struct, rather than as a sub-document.
+//
+// The "alias=key" flag, which may be repeated, defines an alternative key
+// from which the field is also unmarshaled, as useful when a key is renamed
+// in stored documents.  Fields are always marshaled with their primary key.
+// If a document holds several of the keys of the same field, the primary
+// key takes precedence, followed by the aliases in the order they are
+// listed in the tag, whatever the order of the elements in the document.
+//
+// Tags may also follow the conventional format of tags shared by several
+// packages, as in `json:"name" bson:"name,omitempty"`, in which case only
+// the value for the "bson" key is used as described above.  Tags holding
+// no such key/value pairs are used as a whole.
+//
+// Struct fields are always marshaled in the order they are declared, so
+// marshaling the same struct value always produces the same data.  The
+// fields of an inlined struct are marshaled, in their own declaration
+// order, at the position of the inlined field in the outer struct.
+//
+// Keys in BSON documents are always strings, so maps with integer keys are
+// marshaled using the decimal representation of their keys, which are
+// parsed back when unmarshaling into such maps.  Map keys implementing
+// encoding.TextMarshaler are marshaled as the result of their MarshalText
+// method, and are unmarshaled back with UnmarshalText if their pointer
+// implements encoding.TextUnmarshaler.  Integer map keys implementing
+// fmt.Stringer are marshaled as the result of their String method only
+// when their pointer also implements encoding.TextUnmarshaler, so that
+// they may be parsed back.  Other non-string map keys implementing
+// fmt.Stringer are marshaled as the result of their String method, which
+// is a one-way conversion.  An error is returned for keys which can't be
+// converted into a string.
+//
+// The in value may also be a slice or an array other than D, such as a
+// batch of values, in which case it's marshaled as a BSON array, which is
+// a document whose keys are the indexes of the elements in decimal form,
+// starting at "0".
+//
+// Values of type big.Int are marshaled as a Decimal128 when they have at
+// most 34 digits, and otherwise as a document such as {"$bigInt": "-1...9"}
+// holding their decimal digits, which is unmarshaled into interface{}
+// values as a *big.Int.  Values of type big.Rat are marshaled as a string
+// such as "1/3".  Both are unmarshaled back from these and from other
+// numeric kinds.
+//
+// Values of type time.Duration are marshaled as an int64 holding the
+// number of nanoseconds, even when the short flag is set, and are
+// unmarshaled back from any numeric kind.  See Encoder and Decoder for
+// storing them as milliseconds instead.
+//
+// Values of type net.IP are marshaled as binary data of the generic
+// subtype holding the bytes of the address, and may be unmarshaled back
+// from such data or from a string such as "192.0.2.1".  See Encoder for
+// marshaling them as strings instead.
+//
+// Values which can't be marshaled never cause a panic, but are reported
+// through the returned error instead.  Values of types with no BSON
+// representation, such as channels, functions and complex numbers, are
+// reported with a *MarshalError holding ErrUnsupportedType, wrapped in a
+// *FieldError when found within the document.
 func Marshal(in interface{}) (out []byte, err os.Error) {
-	defer handleErr(&err)
-	e := &encoder{make([]byte, 0, initialBufferSize)}
+	e := &encoder{out: make([]byte, 0, initialBufferSize)}
+	defer e.handleErr(&err)
+	e.addDoc(reflect.ValueOf(in))
+	return e.out, nil
+}
+
+// MarshalTo works like Marshal, but serializes the in document using buf
+// as the backing store for the result, so that the memory may be reused
+// across calls.  The length of buf is reset to zero before marshaling, and
+// the returned slice is grown past the capacity of buf if necessary, in
+// which case it won't share memory with buf anymore.
+func MarshalTo(in interface{}, buf []byte) (out []byte, err os.Error) {
+	e := &encoder{out: buf[:0]}
+	defer e.handleErr(&err)
+	e.addDoc(reflect.ValueOf(in))
+	return e.out, nil
+}
+
+// MarshalSize works like Marshal, but the buffer holding the result is
+// preallocated with a capacity of sizeHint bytes.  Callers which know
+// that the document is large may use it to avoid the reallocations
+// otherwise performed while the buffer grows.  The hint doesn't limit
+// the size of the result.
+func MarshalSize(in interface{}, sizeHint int) (out []byte, err os.Error) {
+	if sizeHint < initialBufferSize {
+		sizeHint = initialBufferSize
+	}
+	e := &encoder{out: make([]byte, 0, sizeHint)}
+	defer e.handleErr(&err)
+	e.addDoc(reflect.ValueOf(in))
+	return e.out, nil
+}
+
+// MarshalValue serializes the single in value as it would be marshaled
+// when found within a document, returning its BSON kind and its data
+// without the element name.  The result may be used, for instance, to
+// build a Raw value.
+func MarshalValue(in interface{}) (kind byte, data []byte, err os.Error) {
+	e := &encoder{out: make([]byte, 0, initialBufferSize)}
+	defer e.handleErr(&err)
+	e.addElem("", reflect.ValueOf(in), false)
+	return e.out[0], e.out[2:], nil
+}
+
+// MarshalSorted works like Marshal, but elements of maps are marshaled
+// ordered by their keys rather than in the undefined order in which maps
+// are iterated, so that marshaling the same value always produces the
+// same data.  This is slower than Marshal, and is mostly useful when
+// the resulting data must be compared or hashed.
+func MarshalSorted(in interface{}) (out []byte, err os.Error) {
+	e := &encoder{out: make([]byte, 0, initialBufferSize), sortKeys: true}
+	defer e.handleErr(&err)
 	e.addDoc(reflect.ValueOf(in))
 	return e.out, nil
 }
 
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		return &encoder{out: make([]byte, 0, initialBufferSize)}
+	},
+}
+
+// maxPooledBufferSize is the capacity above which encoder buffers aren't
+// returned to the pool, so that a single huge document doesn't pin its
+// memory indefinitely.
+const maxPooledBufferSize = 64 * 1024
+
+// putEncoder returns e to the pool, unless its buffer grew too large.
+func putEncoder(e *encoder) {
+	if cap(e.out) <= maxPooledBufferSize {
+		encoderPool.Put(e)
+	}
+}
+
+// EncodedSize returns the size in bytes of the data which Marshal would
+// produce for in, or the error it would fail with.  The document is
+// marshaled into a scratch buffer drawn from an internal pool, so that
+// repeated calls for documents of moderate size usually reuse memory
+// rather than allocate it, which allows checking cheaply whether a
+// document fits within MaxDocumentSize before sending it elsewhere.
+// Buffers grown beyond 64KB are not kept for reuse.
+func EncodedSize(in interface{}) (size int, err os.Error) {
+	e := encoderPool.Get().(*encoder)
+	defer putEncoder(e)
+	*e = encoder{out: e.out[:0], path: e.path[:0]}
+	defer e.handleErr(&err)
+	e.addDoc(reflect.ValueOf(in))
+	return len(e.out), nil
+}
+
+// Encoder marshals documents into a scratch buffer which is drawn from an
+// internal pool and reused across calls, avoiding the allocation of a new
+// buffer for every document marshaled.  Since the buffer is reused, data
+// returned by the encoder is only valid until the next call to one of its
+// methods.  An Encoder must not be used from multiple goroutines
+// concurrently.
+type Encoder struct {
+	e *encoder
+
+	// ReinterpretUint64 defines how unsigned integers too large to fit
+	// in an int64 are handled.  BSON has no unsigned 64-bit type, so by
+	// default marshaling such values fails with an error.  If set, they
+	// are instead stored as an int64 with the same bit pattern, which
+	// must be read into an int64 and converted back into an unsigned
+	// value, since negative values don't fit in unsigned types.
+	ReinterpretUint64 bool
+
+	// NilAsNull defines how nil slices and maps are marshaled.  By default
+	// they are marshaled as an empty array, binary or document, like their
+	// empty counterparts.  If set, they are instead marshaled as a BSON
+	// null, so that unmarshaling them restores a nil value.
+	NilAsNull bool
+
+	// StringerFallback defines how values of types which have no BSON
+	// representation, such as channels and functions, are handled.  By
+	// default marshaling them fails with an error.  If set, such values
+	// implementing fmt.Stringer are instead marshaled as the string
+	// returned by their String method.  Types which can be marshaled
+	// are never affected.
+	StringerFallback bool
+
+	// NonFinite defines how NaN and infinite float values are marshaled.
+	// By default they are stored as regular BSON doubles, which some
+	// consumers handle poorly.  See NonFiniteMode for the alternatives.
+	NonFinite NonFiniteMode
+
+	// IPAsString defines how net.IP values are marshaled.  By default
+	// they are stored as binary data of the generic subtype, holding the
+	// 4 or 16 bytes of the address.  If set, they are instead stored as
+	// the string returned by their String method, such as "192.0.2.1" or
+	// "2001:db8::1", while nil and empty values are stored as a BSON null.
+	// Both forms are unmarshaled back into net.IP values.
+	IPAsString bool
+
+	// DurationMillis defines the unit in which time.Duration values are
+	// marshaled.  Durations are always stored as a BSON int64, holding
+	// nanoseconds by default, or whole milliseconds if set, in which case
+	// any fraction of a millisecond is truncated.  The same setting must
+	// be used in the Decoder unmarshaling them back.
+	DurationMillis bool
+
+	// HexObjectIds defines how ObjectId values holding the 24 bytes long
+	// hex representation of an id, rather than its 12 bytes, are handled.
+	// By default marshaling them fails with an error suggesting the use
+	// of ObjectIdHex.  If set, they are instead decoded and marshaled as
+	// the id they represent.
+	HexObjectIds bool
+}
+
+// NonFiniteMode defines how an Encoder marshals NaN and infinite floats.
+type NonFiniteMode int
+
+const (
+	// NonFinitePass marshals non-finite floats as BSON doubles, as done
+	// for any other float value.  This is the default.
+	NonFinitePass NonFiniteMode = iota
+
+	// NonFiniteError makes marshaling fail when a non-finite float
+	// is found.
+	NonFiniteError
+
+	// NonFiniteNull marshals non-finite floats as a BSON null.
+	NonFiniteNull
+)
+
+// NewEncoder returns a new Encoder.  The Release method should be called
+// once the encoder is not necessary anymore, so that its buffer may be
+// reused elsewhere.
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// Marshal serializes the in document as done by the Marshal function.
+// The returned data is held in the encoder's buffer, and is only valid
+// until the next call to a method of enc.
+func (enc *Encoder) Marshal(in interface{}) (out []byte, err os.Error) {
+	if enc.e == nil {
+		enc.e = encoderPool.Get().(*encoder)
+	}
+	defer enc.e.handleErr(&err)
+	enc.e.reset()
+	enc.e.reinterpretUint64 = enc.ReinterpretUint64
+	enc.e.nilAsNull = enc.NilAsNull
+	enc.e.stringerFallback = enc.StringerFallback
+	enc.e.durationMillis = enc.DurationMillis
+	enc.e.nonFinite = enc.NonFinite
+	enc.e.ipAsString = enc.IPAsString
+	enc.e.hexObjectIds = enc.HexObjectIds
+	enc.e.addDoc(reflect.ValueOf(in))
+	return enc.e.out, nil
+}
+
+// Reset truncates the encoder's buffer to zero length while preserving its
+// capacity, so that the memory is reused by the next document marshaled.
+// Data previously returned by the encoder must not be used afterwards.
+// Any state left behind by a Marshal call which failed midway is dropped
+// as well.
+func (enc *Encoder) Reset() {
+	if enc.e != nil {
+		enc.e.reset()
+	}
+}
+
+// Release resets the encoder and returns its buffer to the internal pool.
+// Buffers grown beyond 64KB are dropped rather than pooled.  The encoder
+// may still be used afterwards, in which case a new buffer is obtained.
+func (enc *Encoder) Release() {
+	if enc.e != nil {
+		enc.e.reset()
+		putEncoder(enc.e)
+		enc.e = nil
+	}
+}
+
 // Unmarshal deserializes data from in into the out value.  The out value
-// must be a map or a pointer to a struct (or a pointer to a struct pointer).
-// In the case of struct values, field names are mapped to the struct using
-// the field tag as the key.  If the field has no tag, its lowercased name
-// will be used as the default key.  Nil values are properly initialized
-// when necessary.
+// must be a map, a pointer to a struct (or a pointer to a struct pointer),
+// or a pointer to a D value.  In the case of struct values, field names are
+// mapped to the struct using the field tag as the key.  If the field has no
+// tag, its lowercased name will be used as the default key, unless a
+// different function was set via SetDefaultKeyFunc.  In the case of
+// D values, the elements are stored in the order they are found in the
+// document, while nested documents are unmarshaled as M values.  Nil values
+// are properly initialized when necessary.
 //
 // The target field types of out may not necessarily match the BSON values
 // of the provided data.  If there is a sensible way to unmarshal the values
 // into the Go types, they will be converted.  Otherwise, the incompatible
 // values will be silently skipped.
+//
+// Numeric values are only converted into numeric types able to hold them,
+// so an int64 value too large for an int16 field, or a negative value for
+// a uint field, is skipped as an incompatible value rather than silently
+// wrapped around.  Floating point values unmarshaled into integer types
+// are truncated towards zero, and are likewise skipped when out of range.
+//
+// A BSON null sets the target value to its zero value, so pointers, slices,
+// maps and interfaces become nil, and other types such as ints and strings
+// are zeroed.  Values missing from the document are left untouched, so the
+// two cases may only be told apart when the target isn't zeroed already.
+// For that reason, a null unmarshaled into a pointer to a pointer (e.g.
+// a field of type **int) sets the outer pointer to a new nil pointer, while
+// a missing value leaves the outer pointer untouched.
+//
+// BSON datetimes are unmarshaled into Timestamp values as nanoseconds,
+// into time.Time values as the respective time, and into int64 values as
+// the milliseconds since the epoch exactly as stored, without conversion.
+// Other integer types also receive the milliseconds, going through the
+// nanoseconds of a Timestamp, so int64 should be preferred for datetimes
+// far from the epoch.
+//
+// When the target is an interface{} value, such as an element of an M
+// map or of a []interface{} slice, or the value referenced by an out value
+// of type *interface{}, BSON values are by default unmarshaled into the
+// following Go types, which are also the ones marshaled back into the
+// original BSON types:
+//
+//     double                   float64
+//     string                   string
+//     document                 M
+//     array                    []interface{}
+//     binary (subtype 0x00)    []byte
+//     binary (other subtypes)  Binary
+//     undefined                Undefined
+//     ObjectId                 ObjectId
+//     boolean                  bool
+//     UTC datetime             Timestamp
+//     null                     nil
+//     regular expression       RegEx
+//     DBPointer                DBPointer
+//     JavaScript code          JS, with a nil Scope
+//     symbol                   Symbol
+//     JavaScript with scope    JS
+//     int32                    int
+//     timestamp                MongoTimestamp
+//     int64                    int64
+//     decimal128               Decimal128
+//     min key                  MinKey
+//     max key                  MaxKey
+//
+// Binary values of the generic subtype are unmarshaled as []byte for
+// convenience, while the Binary type is used for the remaining subtypes
+// so that the subtype isn't lost.  Other representations, such as
+// time.Time for datetimes, are obtained by using a target of that type.
+// The Int64Ints and AlwaysBinary settings of Decoder change the types
+// used for int32 values and for binary values of the generic subtype.
+//
+// Values in out are never reset before unmarshaling, so struct fields and
+// map entries with no corresponding element in the document keep their
+// previous values.  When the same out value is reused for unmarshaling
+// several documents, this means data may leak from one document into the
+// next.  See UnmarshalReset for zeroing the value first.
+//
+// Documents holding the same key more than once are accepted, and the
+// elements are unmarshaled in the order they are found, so the last
+// value wins when unmarshaling into maps and struct fields.  D values
+// preserve all of the elements.  See UnmarshalStrict for rejecting such
+// documents instead.
 func Unmarshal(in []byte, out interface{}) (err os.Error) {
+	return unmarshal(&decoder{in: in}, out)
+}
+
+// UnmarshalStrict works like Unmarshal, except that an error is returned
+// if a document unmarshaled into a struct value contains a key with no
+// corresponding field in the struct, rather than silently dropping the
+// value.  Documents unmarshaled into maps may hold any keys.  In addition,
+// an error is returned if any document contains the same key more than
+// once, whatever the target value, and a *TypeError is returned if a
+// numeric value doesn't fit in its target type.
+func UnmarshalStrict(in []byte, out interface{}) (err os.Error) {
+	return unmarshal(&decoder{in: in, strict: true}, out)
+}
+
+// UnmarshalReset works like Unmarshal, except that the out value is reset
+// beforehand: a struct pointed to by out is set to its zero value, all
+// entries of an out map are deleted, and an interface{} value pointed to
+// by out is set to nil, so that a new M value is allocated for it as done
+// by Unmarshal for nil interfaces.  Absent fields are then left as their
+// zero value, as if a new value was allocated for each document, which
+// allows reusing the same value when unmarshaling documents in a loop.
+func UnmarshalReset(in []byte, out interface{}) (err os.Error) {
+	resetDoc(reflect.ValueOf(out))
+	return unmarshal(&decoder{in: in}, out)
+}
+
+func resetDoc(v reflect.Value) {
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct, reflect.Interface:
+		if v.CanSet() {
+			v.Set(reflect.Zero(v.Type()))
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			v.SetMapIndex(k, reflect.Value{})
+		}
+	}
+}
+
+// Decoder unmarshals documents as done by the Unmarshal function, while
+// allowing some details of the process to be customized.  The zero value
+// of Decoder behaves exactly like Unmarshal.
+type Decoder struct {
+	// Location is the location set in time.Time values unmarshaled from
+	// BSON datetimes.  If nil, times are in UTC, matching the wire format.
+	Location *time.Location
+
+	// DurationMillis defines the unit of numbers unmarshaled into
+	// time.Duration values, which are nanoseconds by default, or
+	// milliseconds if set, matching the setting of the same name in
+	// Encoder.
+	DurationMillis bool
+
+	// UnsafeStrings defines whether unmarshaled strings reference the
+	// bytes of the input data directly rather than a copy of them, saving
+	// an allocation per string.  This is unsafe: the input data must not
+	// be modified or reused for as long as any unmarshaled string is in
+	// use, including strings held in maps and interface values, or they
+	// will silently change contents.  Element names are always copied.
+	UnsafeStrings bool
+
+	// Int64Ints defines the type of BSON int32 values unmarshaled into
+	// interface values, including the elements of M, D and []interface{}
+	// values.  By default they become int values, while BSON int64 values
+	// become int64 ones.  If set, both become int64 values, so that code
+	// handling generic documents may rely on a single integer type.
+	Int64Ints bool
+
+	// AlwaysBinary defines the type of BSON binary values of the generic
+	// subtype 0x00 unmarshaled into interface values.  By default they
+	// become []byte values for convenience, while other subtypes become
+	// Binary ones.  If set, all subtypes become Binary values, so that the
+	// subtype is preserved and documents round-trip faithfully.
+	AlwaysBinary bool
+
+	// NumericTimes defines whether BSON int32 and int64 values may be
+	// unmarshaled into time.Time values, as done for documents which store
+	// times as integers.  By default such values are skipped as incompatible
+	// with the time.Time type.  If set, they are interpreted as the number
+	// of milliseconds since the epoch in UTC, the same unit used by BSON
+	// datetimes.  Doubles and values of other kinds are still skipped.
+	NumericTimes bool
+}
+
+// Unmarshal deserializes data from in into the out value as done by the
+// Unmarshal function, according to the settings in dec.
+func (dec *Decoder) Unmarshal(in []byte, out interface{}) (err os.Error) {
+	return unmarshal(&decoder{in: in, loc: dec.Location, durationMillis: dec.DurationMillis,
+		unsafeStrings: dec.UnsafeStrings, int64Ints: dec.Int64Ints,
+		alwaysBinary: dec.AlwaysBinary, numericTimes: dec.NumericTimes}, out)
+}
+
+func unmarshal(d *decoder, out interface{}) (err os.Error) {
 	defer handleErr(&err)
 	v := reflect.ValueOf(out)
 	switch v.Kind() {
 	case reflect.Map, reflect.Ptr:
-		d := &decoder{in: in}
 		d.readDocTo(v)
 	case reflect.Struct:
 		return os.ErrorString("Unmarshal can't deal with struct values. Use a pointer.")
@@ -373,6 +1336,93 @@ func Unmarshal(in []byte, out interface{}) (err os.Error) {
 	return nil
 }
 
+// UnmarshalArray deserializes the elements of the BSON array in one at a
+// time, calling fn with the index and the value of each element, so that
+// large arrays may be processed without holding all of their elements in
+// memory.  Each element is unmarshaled into a new value of type elemType,
+// with the same conversions done by Unmarshal, and elements which can't
+// be converted are skipped.  Iteration stops at the first error returned
+// by fn, which is then returned by UnmarshalArray.
+//
+// Arrays use the same layout as documents, with the consecutive indexes
+// "0", "1", "2", etc, as keys.  An error is returned if in holds any other
+// keys, such as when in is a regular document rather than an array.
+func UnmarshalArray(in []byte, elemType reflect.Type, fn func(i int, v interface{}) os.Error) (err os.Error) {
+	defer handleErr(&err)
+	d := &decoder{in: in}
+	i := 0
+	d.readDocWith(func(kind byte, name string) {
+		if name != strconv.Itoa(i) {
+			panic(fmt.Sprintf("Data is not a BSON array: found key %q at index %d", name, i))
+		}
+		e := reflect.New(elemType).Elem()
+		if d.readElemTo(e, kind) {
+			if err := fn(i, e.Interface()); err != nil {
+				panic(err)
+			}
+		}
+		i++
+	})
+	return nil
+}
+
+// UnmarshalAll deserializes the concatenation of documents in in, as found
+// for instance in the replies of the MongoDB wire protocol, appending each
+// document to the slice pointed to by out.  The element type of the slice
+// may be any type which a document may be unmarshaled into as done by
+// Unmarshal, such as M, D, a struct, or a pointer to a struct.  An error
+// is returned if in holds data after the last complete document, which
+// includes the case of a truncated document.
+func UnmarshalAll(in []byte, out interface{}) (err os.Error) {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return os.ErrorString("UnmarshalAll needs a pointer to a slice.")
+	}
+	defer handleErr(&err)
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	d := &decoder{in: in}
+	for d.i < len(in) {
+		elem := reflect.New(elemType)
+		d.readDocTo(elem)
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return nil
+}
+
+// Validate verifies that in holds exactly one well formed BSON document,
+// checking the length prefixes, the termination of strings, and the
+// element kinds of all documents and arrays within it, without
+// unmarshaling any values.
+func Validate(in []byte) (err os.Error) {
+	defer handleErr(&err)
+	d := &decoder{in: in}
+	d.validateDoc()
+	if d.i != len(in) {
+		corrupted()
+	}
+	return nil
+}
+
+// DocumentLength returns the length of the document at the start of in, as
+// declared by its leading int32 length prefix, which is useful for splitting
+// a buffer holding several documents.  An error is returned if in is too
+// short to hold a document, or if the declared length is invalid or exceeds
+// the length of in.  The content of the document isn't verified.
+func DocumentLength(in []byte) (int, os.Error) {
+	if len(in) < 5 {
+		return 0, os.NewError(fmt.Sprintf("Document needs at least 5 bytes (got %d)", len(in)))
+	}
+	l := int(int32(uint32(in[0]) | uint32(in[1])<<8 | uint32(in[2])<<16 | uint32(in[3])<<24))
+	if l < 5 {
+		return 0, os.ErrorString("Document is corrupted")
+	}
+	if l > len(in) {
+		return 0, os.NewError(fmt.Sprintf("Document length %d exceeds the %d bytes available", l, len(in)))
+	}
+	return l, nil
+}
+
 // Unmarshal deserializes raw into the out value.  In addition to whole
 // documents, Raw's Unmarshal may also be used to unmarshal the data for
 // individual elements within a partially unmarshalled document.  This
@@ -396,6 +1446,103 @@ func (raw Raw) Unmarshal(out interface{}) (err os.Error) {
 	return nil
 }
 
+// Lookup returns the element with the given key in the raw document
+// without unmarshaling any other elements.  This is useful, for instance,
+// to find out the type of a document before deciding which value to
+// unmarshal it into.  If raw is not a document (kind 0x03), if the key
+// is not found, or if the document is corrupted, ok is false.
+func (raw Raw) Lookup(key string) (elem Raw, ok bool) {
+	if raw.Kind != KindDocument {
+		return Raw{}, false
+	}
+	var err os.Error
+	defer func() {
+		if err != nil {
+			elem, ok = Raw{}, false
+		}
+	}()
+	defer handleErr(&err)
+	d := &decoder{in: raw.Data}
+	return d.lookupElem(key)
+}
+
+// ToD returns the elements of the document held by raw as a D value, in
+// the order they are found in the document.  Unlike when unmarshaling into
+// a D value, nested documents are returned as D values rather than as M
+// values, and arrays as []interface{} values, so that the order of all the
+// elements is preserved.  If raw is not a document, a *TypeError is
+// returned, and an error is also returned if the document is corrupted.
+func (raw Raw) ToD() (doc D, err os.Error) {
+	if raw.Kind != KindDocument && raw.Kind != 0x00 {
+		return nil, &TypeError{typeD, raw.Kind}
+	}
+	defer handleErr(&err)
+	d := &decoder{in: raw.Data, ordered: true}
+	doc = d.readDocD().(D)
+	if d.i != len(raw.Data) {
+		corrupted()
+	}
+	return doc, nil
+}
+
+// Map returns the elements of the document held by raw as an M value,
+// unmarshaled exactly as done by Unmarshal into a new M map.  If raw is
+// not a document, a *TypeError is returned, and an error is also returned
+// if the document is corrupted.
+func (raw Raw) Map() (m M, err os.Error) {
+	if raw.Kind != KindDocument && raw.Kind != 0x00 {
+		return nil, &TypeError{reflect.TypeOf(m), raw.Kind}
+	}
+	defer handleErr(&err)
+	d := &decoder{in: raw.Data}
+	result := make(M)
+	d.readMapDocTo(reflect.ValueOf(result))
+	if d.i != len(raw.Data) {
+		corrupted()
+	}
+	return result, nil
+}
+
+// FieldError is returned when marshaling fails on a specific element of
+// a document.  Path holds the keys leading to the element from the outer
+// document, separated by dots, and Err is the underlying error.
+type FieldError struct {
+	Path string
+	Err  os.Error
+}
+
+func (e *FieldError) String() string {
+	return fmt.Sprintf("field %q: %s", e.Path, e.Err.String())
+}
+
+// ErrTruncated is returned when unmarshaling data which ends before the
+// end of a document, as declared by its length prefix, is reached.  This
+// happens for instance when a document was cut short while being
+// transferred, and may be told apart from other problems in the data,
+// which are reported as a corrupted document.
+var ErrTruncated = os.NewError("Document is truncated")
+
+// ErrUnsupportedType is held in the Err field of a MarshalError when the
+// value being marshaled has a type with no BSON representation, such as
+// a channel, a function, or a complex number.
+var ErrUnsupportedType = os.NewError("type has no BSON representation")
+
+// MarshalError is returned when a value can't be marshaled because of its
+// type.  Type is the type of the offending value, and Err is the reason
+// for the failure, such as ErrUnsupportedType.  When the value is found
+// within a document, the MarshalError is held in the Err field of a
+// FieldError reporting its location.
+type MarshalError struct {
+	Type reflect.Type
+	Err  os.Error
+}
+
+func (e *MarshalError) String() string {
+	return "Can't marshal " + e.Type.String() + ": " + e.Err.String()
+}
+
+// TypeError is returned when a BSON value can't be unmarshaled into the
+// requested type, in cases where incompatible values aren't just skipped.
 type TypeError struct {
 	Type reflect.Type
 	Kind byte
@@ -411,6 +1558,13 @@ func (e *TypeError) String() string {
 type structFields struct {
 	Map  map[string]fieldInfo
 	List []fieldInfo
+
+	// Alternative keys from which fields are also unmarshaled, or nil
+	// if no field has an alias.
+	Aliases map[string]fieldInfo
+
+	// Name of the first unexported field holding a tag, if any.
+	TaggedPrivate string
 }
 
 type fieldInfo struct {
@@ -418,11 +1572,54 @@ type fieldInfo struct {
 	Num         int
 	Conditional bool
 	Short       bool
+	Inline      []int
+
+	// Aliases of the field, and for entries of structFields.Aliases, the
+	// position of the alias in that list plus one.
+	Aliases []string
+	Alias   int
 }
 
 var fieldMap = make(map[string]*structFields)
 var fieldMapMutex sync.RWMutex
 
+// Function building the key of fields without a tag, and a generation
+// number which changes with it so that stale results aren't cached.
+var defaultKeyFunc = strings.ToLower
+var defaultKeyGen int
+
+// Whether unexported fields holding a tag are reported as an error.
+var checkUnexportedTags bool
+
+// SetDefaultKeyFunc defines the function used to build the key of struct
+// fields which have no explicit key in their tag.  The function receives
+// the field name, and must return the key to be used for it.  By default
+// the lowercased field name is used, which may be restored by providing
+// a nil function.  Changing the function affects all structs marshaled
+// or unmarshaled afterwards.
+func SetDefaultKeyFunc(f func(fieldName string) string) {
+	if f == nil {
+		f = strings.ToLower
+	}
+	fieldMapMutex.Lock()
+	defaultKeyFunc = f
+	defaultKeyGen++
+	fieldMap = make(map[string]*structFields)
+	fieldMapMutex.Unlock()
+}
+
+// SetCheckUnexportedTags defines whether marshaling and unmarshaling
+// structs with an unexported field holding a tag, such as a field named
+// "name" rather than "Name", fails with an error.  Unexported fields are
+// never marshaled or unmarshaled, so tagging one is almost always a
+// mistake which would otherwise go unnoticed.  Fields tagged with "-" are
+// not reported.  The check is disabled by default.
+func SetCheckUnexportedTags(check bool) {
+	fieldMapMutex.Lock()
+	checkUnexportedTags = check
+	fieldMapMutex.Unlock()
+}
+
 func getStructFields(st reflect.Type) (*structFields, os.Error) {
 	path := st.PkgPath()
 	name := st.Name()
@@ -430,24 +1627,54 @@ func getStructFields(st reflect.Type) (*structFields, os.Error) {
 	fullName := path + "." + name
 	fieldMapMutex.RLock()
 	fields, found := fieldMap[fullName]
+	keyFunc, keyGen := defaultKeyFunc, defaultKeyGen
+	checkTags := checkUnexportedTags
 	fieldMapMutex.RUnlock()
 	if found {
-		return fields, nil
+		return checkStructFields(st, fields, checkTags)
 	}
 
 	n := st.NumField()
 	fieldsMap := make(map[string]fieldInfo)
-	fieldsList := make([]fieldInfo, n)
+	fieldsList := make([]fieldInfo, 0, n)
+	taggedPrivate := ""
+	var aliasesMap map[string]fieldInfo
 	for i := 0; i != n; i++ {
 		field := st.Field(i)
+		tag := fieldTag(field)
 		if field.PkgPath != "" {
+			if tag != "" && tag != "-" && taggedPrivate == "" {
+				taggedPrivate = field.Name
+			}
 			continue // Private field
 		}
+		if tag == "-" {
+			continue // Explicitly excluded
+		}
 
 		info := fieldInfo{Num: i}
+		inline := false
 
-		if s := strings.LastIndex(field.Tag, "/"); s != -1 {
-			for _, c := range field.Tag[s+1:] {
+		if s := strings.Index(tag, ","); s != -1 {
+			for _, flag := range strings.Split(tag[s+1:], ",") {
+				switch flag {
+				case "omitempty":
+					info.Conditional = true
+				case "minsize":
+					info.Short = true
+				case "inline":
+					inline = true
+				default:
+					if strings.HasPrefix(flag, "alias=") && len(flag) > 6 {
+						info.Aliases = append(info.Aliases, flag[6:])
+						break
+					}
+					panic("Unsupported field flag: " + flag)
+				}
+			}
+			tag = tag[:s]
+		} else if s := strings.LastIndex(tag, "/"); s != -1 {
+			for _, c := range tag[s+1:] {
 				switch c {
 				case int('c'):
 					info.Conditional = true
@@ -457,13 +1684,55 @@ func getStructFields(st reflect.Type) (*structFields, os.Error) {
 					panic("Unsupported field flag: " + string([]int{c}))
 				}
 			}
-			field.Tag = field.Tag[:s]
+			tag = tag[:s]
 		}
 
-		if field.Tag != "" {
-			info.Key = field.Tag
+		if inline {
+			if field.Type.Kind() != reflect.Struct {
+				panic("Option ,inline needs a struct value field")
+			}
+			if info.Aliases != nil {
+				panic("Option ,alias can't be used with ,inline")
+			}
+			inlineFields, err := getStructFields(field.Type)
+			if err != nil {
+				return nil, err
+			}
+			if taggedPrivate == "" {
+				taggedPrivate = inlineFields.TaggedPrivate
+			}
+			for _, finfo := range inlineFields.List {
+				if _, found = fieldsMap[finfo.Key]; found {
+					msg := "Duplicated key '" + finfo.Key + "' in struct " + st.String()
+					return nil, os.NewError(msg)
+				}
+				if finfo.Inline == nil {
+					finfo.Inline = []int{i, finfo.Num}
+				} else {
+					finfo.Inline = append([]int{i}, finfo.Inline...)
+				}
+				fieldsList = append(fieldsList, finfo)
+				fieldsMap[finfo.Key] = finfo
+				for j, alias := range finfo.Aliases {
+					if _, found = aliasesMap[alias]; found {
+						msg := "Duplicated key '" + alias + "' in struct " + st.String()
+						return nil, os.NewError(msg)
+					}
+					if aliasesMap == nil {
+						aliasesMap = make(map[string]fieldInfo)
+					}
+					ainfo := finfo
+					ainfo.Alias = j + 1
+					aliasesMap[alias] = ainfo
+				}
+			}
+			continue
+		}
+
+		if tag != "" {
+			info.Key = tag
 		} else {
-			info.Key = strings.ToLower(field.Name)
+			info.Key = keyFunc(field.Name)
 		}
 
 		if _, found = fieldsMap[info.Key]; found {
@@ -471,17 +1740,61 @@ func getStructFields(st reflect.Type) (*structFields, os.Error) {
 			return nil, os.NewError(msg)
 		}
 
-		fieldsList[len(fieldsMap)] = info
+		fieldsList = append(fieldsList, info)
 		fieldsMap[info.Key] = info
+		for j, alias := range info.Aliases {
+			if _, found = aliasesMap[alias]; found {
+				msg := "Duplicated key '" + alias + "' in struct " + st.String()
+				return nil, os.NewError(msg)
+			}
+			if aliasesMap == nil {
+				aliasesMap = make(map[string]fieldInfo)
+			}
+			ainfo := info
+			ainfo.Alias = j + 1
+			aliasesMap[alias] = ainfo
+		}
 	}
 
-	fields = &structFields{fieldsMap, fieldsList[:len(fieldsMap)]}
+	// Aliases can't shadow primary keys, wherever they're declared.
+	for alias := range aliasesMap {
+		if _, found = fieldsMap[alias]; found {
+			msg := "Duplicated key '" + alias + "' in struct " + st.String()
+			return nil, os.NewError(msg)
+		}
+	}
+
+	fields = &structFields{fieldsMap, fieldsList, aliasesMap, taggedPrivate}
 
 	if fullName != "." {
 		fieldMapMutex.Lock()
-		fieldMap[fullName] = fields
+		if keyGen == defaultKeyGen {
+			fieldMap[fullName] = fields
+		}
 		fieldMapMutex.Unlock()
 	}
 
+	return checkStructFields(st, fields, checkTags)
+}
+
+// fieldTag returns the part of the tag of field which is relevant for
+// BSON.  Tags in the conventional format, such as `json:"x" bson:"y"`,
+// hold it as the value for the "bson" key, while tags not in that format,
+// such as "y,omitempty", are used as a whole for compatibility.
+func fieldTag(field reflect.StructField) string {
+	tag := reflect.StructTag(field.Tag).Get("bson")
+	if tag == "" && strings.Index(string(field.Tag), ":") < 0 {
+		tag = string(field.Tag)
+	}
+	return tag
+}
+
+// checkStructFields returns fields, or an error if check is true and
+// the struct st has an unexported field holding a tag.
+func checkStructFields(st reflect.Type, fields *structFields, check bool) (*structFields, os.Error) {
+	if check && fields.TaggedPrivate != "" {
+		msg := "Unexported field '" + fields.TaggedPrivate + "' in struct " + st.String() + " has a tag"
+		return nil, os.NewError(msg)
+	}
 	return fields, nil
 }
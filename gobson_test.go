@@ -32,10 +32,20 @@ package bson_test
 
 import (
 	. "launchpad.net/gocheck"
+	"big"
 	"encoding/binary"
+	"bytes"
+	"fmt"
+	"io"
+	"json"
+	"math"
+	"net"
 	"testing"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
+	"os"
 	"launchpad.net/gobson/bson"
 )
 
@@ -104,6 +114,556 @@ func (s *S) TestMarshalSampleItems(c *C) {
 	}
 }
 
+func (s *S) TestMarshalToSampleItems(c *C) {
+	buf := make([]byte, 3, 256)
+	for i, item := range sampleItems {
+		data, err := bson.MarshalTo(item.obj, buf)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, item.data,
+			Bug("Failed on item %d", i))
+		// The provided buffer must have been reused.
+		c.Assert(&data[0] == &buf[:1][0], Equals, true)
+	}
+}
+
+func (s *S) TestMarshalToGrowsBuffer(c *C) {
+	buf := make([]byte, 0, 4)
+	data, err := bson.MarshalTo(sampleItems[1].obj, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, sampleItems[1].data)
+}
+
+func (s *S) TestMarshalValue(c *C) {
+	for i, item := range allItems {
+		if item.data == "" {
+			continue
+		}
+		kind, data, err := bson.MarshalValue(item.obj.(bson.M)["_"])
+		c.Assert(err, IsNil)
+		c.Assert(kind, Equals, item.data[0], Bug("Failed on item %d", i))
+		c.Assert(string(data), Equals, item.data[3:], Bug("Failed on item %d", i))
+	}
+
+	kind, data, err := bson.MarshalValue("yo")
+	c.Assert(err, IsNil)
+	var str string
+	c.Assert(bson.Raw{kind, data}.Unmarshal(&str), IsNil)
+	c.Assert(str, Equals, "yo")
+
+	_, _, err = bson.MarshalValue(1i)
+	c.Assert(err, Matches, "Can't marshal complex128: type has no BSON representation")
+}
+
+func (s *S) TestMarshalTopLevelArray(c *C) {
+	expected := wrapInDoc("\x020\x00\x02\x00\x00\x00a\x00\x101\x00\x02\x00\x00\x00")
+	for _, in := range []interface{}{[]interface{}{"a", 2}, &[2]interface{}{"a", 2}} {
+		data, err := bson.Marshal(in)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, expected)
+	}
+
+	data, err := bson.Marshal(make([]bson.M, 11))
+	c.Assert(err, IsNil)
+	var d bson.D
+	c.Assert(bson.Unmarshal(data, &d), IsNil)
+	c.Assert(len(d), Equals, 11)
+	for i, elem := range d {
+		c.Assert(elem.Name, Equals, strconv.Itoa(i))
+	}
+}
+
+func (s *S) TestMarshalSorted(c *C) {
+	m := bson.M{"c": 1, "a": 2, "b": bson.M{"z": nil, "y": true}, "aa": "x"}
+	expected := wrapInDoc("\x10a\x00\x02\x00\x00\x00" +
+		"\x02aa\x00\x02\x00\x00\x00x\x00" +
+		"\x03b\x00" + wrapInDoc("\x08y\x00\x01\x0Az\x00") +
+		"\x10c\x00\x01\x00\x00\x00")
+	for i := 0; i < 10; i++ {
+		data, err := bson.MarshalSorted(m)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, expected)
+	}
+}
+
+func (s *S) TestEncoderMarshalSampleItems(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	for i, item := range sampleItems {
+		data, err := enc.Marshal(item.obj)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, item.data,
+			Bug("Failed on item %d", i))
+	}
+}
+
+func (s *S) TestEncoderMarshalAfterRelease(c *C) {
+	enc := bson.NewEncoder()
+	_, err := enc.Marshal(sampleItems[0].obj)
+	c.Assert(err, IsNil)
+	enc.Release()
+	data, err := enc.Marshal(sampleItems[1].obj)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, sampleItems[1].data)
+	enc.Release()
+}
+
+func (s *S) TestEncoderReset(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	enc.Reset()
+	data1, err := enc.Marshal(sampleItems[1].obj)
+	c.Assert(err, IsNil)
+	enc.Reset()
+	data2, err := enc.Marshal(sampleItems[0].obj)
+	c.Assert(err, IsNil)
+	c.Assert(string(data2), Equals, sampleItems[0].data)
+	c.Assert(&data1[0] == &data2[0], Equals, true)
+}
+
+func (s *S) TestEncoderMarshalError(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	data, err := enc.Marshal(int64(123))
+	c.Assert(err, Matches, "Can't marshal int64 as a BSON document")
+	c.Assert(data, IsNil)
+}
+
+func (s *S) TestEncoderReinterpretUint64(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	_, err := enc.Marshal(bson.M{"": uint64(1 << 63)})
+	c.Assert(err, Matches, `field "": BSON has no uint64 type, and value is too large to fit correctly in an int64`)
+
+	enc.ReinterpretUint64 = true
+	data, err := enc.Marshal(bson.M{"": uint64(1<<64 - 1)})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x12\x00\xff\xff\xff\xff\xff\xff\xff\xff"))
+
+	m := bson.M{}
+	err = bson.Unmarshal(data, m)
+	c.Assert(err, IsNil)
+	c.Assert(uint64(m[""].(int64)), Equals, uint64(1<<64-1))
+}
+
+func (s *S) TestEncoderNilAsNull(c *C) {
+	type T struct {
+		S []int
+		B []byte
+		M map[string]int
+		D bson.D
+	}
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	data, err := enc.Marshal(&T{})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x04s\x00\x05\x00\x00\x00\x00"+
+		"\x05b\x00\x00\x00\x00\x00\x00"+
+		"\x03m\x00\x05\x00\x00\x00\x00"+
+		"\x03d\x00\x05\x00\x00\x00\x00"))
+
+	enc.NilAsNull = true
+	data, err = enc.Marshal(&T{})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x0As\x00\x0Ab\x00\x0Am\x00\x0Ad\x00"))
+
+	t := &T{[]int{1}, []byte{1}, map[string]int{"a": 1}, bson.D{{"a", 1}}}
+	err = bson.Unmarshal(data, t)
+	c.Assert(err, IsNil)
+	c.Assert(t.S == nil && t.B == nil && t.M == nil && t.D == nil, Equals, true, Bug("Got %#v", t))
+
+	// Empty values are still marshaled as such.
+	data, err = enc.Marshal(&T{[]int{}, []byte{}, map[string]int{}, bson.D{}})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x04s\x00\x05\x00\x00\x00\x00"+
+		"\x05b\x00\x00\x00\x00\x00\x00"+
+		"\x03m\x00\x05\x00\x00\x00\x00"+
+		"\x03d\x00\x05\x00\x00\x00\x00"))
+}
+
+type stringerChan chan int
+
+func (ch stringerChan) String() string {
+	return "a channel"
+}
+
+func (s *S) TestEncoderStringerFallback(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	doc := bson.M{"ch": make(stringerChan), "id": bson.ObjectId("0123456789ab")}
+	_, err := enc.Marshal(doc)
+	c.Assert(err, Matches, `field "ch": Can't marshal bson_test.stringerChan: type has no BSON representation`)
+
+	enc.StringerFallback = true
+	data, err := enc.Marshal(doc)
+	c.Assert(err, IsNil)
+	m := bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m, Equals, bson.M{"ch": "a channel", "id": bson.ObjectId("0123456789ab")})
+
+	// Unsupported values which aren't stringers still fail.
+	_, err = enc.Marshal(bson.M{"c": 1i})
+	c.Assert(err, Matches, `field "c": Can't marshal complex128: type has no BSON representation`)
+}
+
+func (s *S) TestEncoderNonFinite(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	for i, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		doc := bson.D{{"f", f}, {"g", float32(f)}, {"n", 1.5}}
+		data, err := enc.Marshal(doc)
+		c.Assert(err, IsNil)
+		var out bson.D
+		c.Assert(bson.Unmarshal(data, &out), IsNil)
+		c.Assert(len(out), Equals, 3)
+		got := out[0].Value.(float64)
+		c.Assert(got == f || math.IsNaN(got) && math.IsNaN(f), Equals, true, Bug("Failed on item %d", i))
+
+		enc.NonFinite = bson.NonFiniteNull
+		data, err = enc.Marshal(doc)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, wrapInDoc("\x0Af\x00\x0Ag\x00\x01n\x00\x00\x00\x00\x00\x00\x00\xf8\x3f"),
+			Bug("Failed on item %d", i))
+
+		enc.NonFinite = bson.NonFiniteError
+		_, err = enc.Marshal(doc)
+		c.Assert(err, Matches, `field "f": Can't marshal non-finite float value (NaN|[+-]Inf)`)
+
+		enc.NonFinite = bson.NonFinitePass
+	}
+}
+
+type ipDoc struct {
+	IP net.IP
+}
+
+func (s *S) TestMarshalIP(c *C) {
+	ips := []net.IP{
+		net.IP{192, 0, 2, 1},
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("2001:db8::1"),
+	}
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	for i, ip := range ips {
+		data, err := bson.Marshal(&ipDoc{ip})
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, wrapInDoc("\x05ip\x00"+string([]byte{byte(len(ip)), 0, 0, 0, 0})+string(ip)),
+			Bug("Failed on item %d", i))
+		var doc ipDoc
+		c.Assert(bson.Unmarshal(data, &doc), IsNil)
+		c.Assert(doc.IP, Equals, ip, Bug("Failed on item %d", i))
+
+		enc.IPAsString = true
+		data, err = enc.Marshal(&ipDoc{ip})
+		enc.IPAsString = false
+		c.Assert(err, IsNil)
+		str := ip.String()
+		c.Assert(string(data), Equals, wrapInDoc("\x02ip\x00"+string([]byte{byte(len(str) + 1), 0, 0, 0})+str+"\x00"),
+			Bug("Failed on item %d", i))
+		doc = ipDoc{}
+		c.Assert(bson.Unmarshal(data, &doc), IsNil)
+		c.Assert(doc.IP.Equal(ip), Equals, true, Bug("Failed on item %d", i))
+	}
+
+	// Nil and empty addresses have no string form, and are stored as null.
+	enc.IPAsString = true
+	for _, ip := range []net.IP{nil, net.IP{}} {
+		data, err := enc.Marshal(&ipDoc{ip})
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, wrapInDoc("\x0Aip\x00"))
+		doc := ipDoc{net.IP{192, 0, 2, 1}}
+		c.Assert(bson.Unmarshal(data, &doc), IsNil)
+		c.Assert(doc.IP, IsNil)
+	}
+	enc.IPAsString = false
+
+	// IPv4 addresses unmarshaled from strings use the 4 bytes form.
+	var doc ipDoc
+	data, err := bson.Marshal(bson.M{"ip": "192.0.2.1"})
+	c.Assert(err, IsNil)
+	c.Assert(bson.Unmarshal(data, &doc), IsNil)
+	c.Assert(doc.IP, Equals, net.IP{192, 0, 2, 1})
+
+	// Invalid addresses are skipped.
+	doc = ipDoc{}
+	data, err = bson.Marshal(bson.M{"ip": "bogus"})
+	c.Assert(err, IsNil)
+	c.Assert(bson.Unmarshal(data, &doc), IsNil)
+	c.Assert(doc.IP, IsNil)
+}
+
+type durationDoc struct {
+	D time.Duration
+	S time.Duration ",short"
+}
+
+func (s *S) TestMarshalDuration(c *C) {
+	doc := durationDoc{1500 * time.Millisecond, 2 * time.Nanosecond}
+	data, err := bson.Marshal(doc)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc(
+		"\x12d\x00\x00\x2f\x68\x59\x00\x00\x00\x00"+
+			"\x12s\x00\x02\x00\x00\x00\x00\x00\x00\x00"))
+
+	var out durationDoc
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out, Equals, doc)
+
+	// Other numeric kinds are accepted as well.
+	c.Assert(bson.Unmarshal([]byte(wrapInDoc("\x10d\x00\x05\x00\x00\x00")), &out), IsNil)
+	c.Assert(out.D, Equals, 5*time.Nanosecond)
+}
+
+func (s *S) TestEncoderDurationMillis(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	enc.DurationMillis = true
+	data, err := enc.Marshal(durationDoc{1500*time.Millisecond + 1, 2 * time.Nanosecond})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc(
+		"\x12d\x00\xdc\x05\x00\x00\x00\x00\x00\x00"+
+			"\x12s\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+
+	var out durationDoc
+	dec := &bson.Decoder{DurationMillis: true}
+	c.Assert(dec.Unmarshal(data, &out), IsNil)
+	c.Assert(out, Equals, durationDoc{1500 * time.Millisecond, 0})
+
+	c.Assert(dec.Unmarshal([]byte(wrapInDoc("\x01d\x00\x00\x00\x00\x00\x00\x00\xf8\x3f")), &out), IsNil)
+	c.Assert(out.D, Equals, 1500*time.Microsecond)
+
+	// Values too large for a duration in nanoseconds are skipped.
+	out = durationDoc{}
+	c.Assert(dec.Unmarshal([]byte(wrapInDoc("\x12d\x00\x00\x00\x00\x00\x00\x00\x00\x01")), &out), IsNil)
+	c.Assert(out.D, Equals, time.Duration(0))
+}
+
+func (s *S) TestEncoderHexObjectIds(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	enc.HexObjectIds = true
+	hexId := bson.ObjectId("4d88e15b60f486e428412dc9")
+	data, err := enc.Marshal(bson.M{"_id": hexId, "p": bson.DBPointer{"db.c", hexId}})
+	c.Assert(err, IsNil)
+
+	var out struct {
+		Id bson.ObjectId "_id"
+		P  bson.DBPointer
+	}
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.Id, Equals, bson.ObjectIdHex(string(hexId)))
+	c.Assert(out.P.Id, Equals, out.Id)
+
+	// Other lengths are still rejected.
+	_, err = enc.Marshal(bson.M{"_id": bson.ObjectId("tooshort")})
+	c.Assert(err, Matches, `field "_id": ObjectIDs must be exactly 12 bytes long \(got 8\)`)
+}
+
+func (s *S) TestDecoderInt64Ints(c *C) {
+	data, err := bson.Marshal(bson.D{{"a", int32(1)}, {"b", int64(2)}, {"c", []int32{3}}})
+	c.Assert(err, IsNil)
+
+	m := bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m["a"], Equals, 1)
+	c.Assert(m["b"], Equals, int64(2))
+
+	dec := &bson.Decoder{Int64Ints: true}
+	m = bson.M{}
+	c.Assert(dec.Unmarshal(data, m), IsNil)
+	c.Assert(m["a"], Equals, int64(1))
+	c.Assert(m["b"], Equals, int64(2))
+	c.Assert(m["c"], Equals, []interface{}{int64(3)})
+
+	// Typed targets are unaffected.
+	var out struct{ A int32 }
+	c.Assert(dec.Unmarshal(data, &out), IsNil)
+	c.Assert(out.A, Equals, int32(1))
+}
+
+func (s *S) TestDecoderAlwaysBinary(c *C) {
+	data, err := bson.Marshal(bson.D{{"g", []byte("gen")}, {"u", bson.Binary{0x80, []byte("usr")}}})
+	c.Assert(err, IsNil)
+
+	dec := &bson.Decoder{AlwaysBinary: true}
+	var d bson.D
+	c.Assert(dec.Unmarshal(data, &d), IsNil)
+	c.Assert(d, Equals, bson.D{
+		{"g", bson.Binary{0x00, []byte("gen")}},
+		{"u", bson.Binary{0x80, []byte("usr")}},
+	})
+
+	again, err := bson.Marshal(d)
+	c.Assert(err, IsNil)
+	c.Assert(string(again), Equals, string(data))
+
+	// Typed targets are unaffected.
+	var out struct{ G []byte }
+	c.Assert(dec.Unmarshal(data, &out), IsNil)
+	c.Assert(out.G, Equals, []byte("gen"))
+}
+
+func (s *S) TestDecoderUnsafeStrings(c *C) {
+	data, err := bson.Marshal(bson.M{"s": "hello", "e": ""})
+	c.Assert(err, IsNil)
+
+	var out struct{ S, E string }
+	dec := &bson.Decoder{UnsafeStrings: true}
+	c.Assert(dec.Unmarshal(data, &out), IsNil)
+	c.Assert(out.S, Equals, "hello")
+	c.Assert(out.E, Equals, "")
+
+	// The string references the input, so changing it is visible.
+	copy(data[bytes.Index(data, []byte("hello")):], "HELLO")
+	c.Assert(out.S, Equals, "HELLO")
+}
+
+var stringsDoc, _ = bson.Marshal(bson.M{
+	"a": "The quick brown fox", "b": "jumps over", "c": "the lazy dog",
+	"d": []string{"one", "two", "three", "four", "five"},
+})
+
+type stringsDocType struct {
+	A, B, C string
+	D       []string
+}
+
+func (s *S) BenchmarkUnmarshalStrings(c *C) {
+	dec := &bson.Decoder{}
+	for i := 0; i < c.N; i++ {
+		var out stringsDocType
+		dec.Unmarshal(stringsDoc, &out)
+	}
+}
+
+func (s *S) BenchmarkUnmarshalUnsafeStrings(c *C) {
+	dec := &bson.Decoder{UnsafeStrings: true}
+	for i := 0; i < c.N; i++ {
+		var out stringsDocType
+		dec.Unmarshal(stringsDoc, &out)
+	}
+}
+
+func (s *S) BenchmarkMarshal(c *C) {
+	for i := 0; i < c.N; i++ {
+		bson.Marshal(sampleItems[1].obj)
+	}
+}
+
+func (s *S) BenchmarkEncoderMarshal(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	for i := 0; i < c.N; i++ {
+		enc.Marshal(sampleItems[1].obj)
+	}
+}
+
+func (s *S) TestMarshalSize(c *C) {
+	for _, hint := range []int{-1, 0, 4, 1024} {
+		data, err := bson.MarshalSize(sampleItems[1].obj, hint)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, sampleItems[1].data)
+	}
+	data, err := bson.MarshalSize(bson.M{}, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(cap(data), Equals, 1024)
+
+	_, err = bson.MarshalSize(bson.M{"": uint64(1 << 63)}, 1024)
+	c.Assert(err, Matches, `field "": BSON has no uint64 type, .*`)
+}
+
+func (s *S) TestEncodedSize(c *C) {
+	for i, item := range sampleItems {
+		size, err := bson.EncodedSize(item.obj)
+		c.Assert(err, IsNil)
+		c.Assert(size, Equals, len(item.data), Bug("Failed on item %d", i))
+	}
+	for i, item := range allItems {
+		size, err := bson.EncodedSize(item.obj)
+		c.Assert(err, IsNil)
+		c.Assert(size, Equals, len(wrapInDoc(item.data)), Bug("Failed on item %d", i))
+	}
+
+	// Settings of encoders previously released don't leak in.
+	enc := bson.NewEncoder()
+	enc.ReinterpretUint64 = true
+	_, err := enc.Marshal(bson.M{"": uint64(1 << 63)})
+	c.Assert(err, IsNil)
+	enc.Release()
+	_, err = bson.EncodedSize(bson.M{"": uint64(1 << 63)})
+	c.Assert(err, Matches, `field "": BSON has no uint64 type, .*`)
+}
+
+// largeDoc marshals into a document of about 1MB.
+var largeDoc = bson.M{"a": make([]int32, 1<<17)}
+
+func (s *S) BenchmarkMarshalLarge(c *C) {
+	for i := 0; i < c.N; i++ {
+		bson.Marshal(largeDoc)
+	}
+}
+
+func (s *S) BenchmarkMarshalSizeLarge(c *C) {
+	for i := 0; i < c.N; i++ {
+		bson.MarshalSize(largeDoc, 1<<21)
+	}
+}
+
+type structSliceItem struct {
+	Name  string
+	Count int ",omitempty"
+	Inner struct{ Tag string } ",inline"
+}
+
+func (s *S) TestMarshalStructSlice(c *C) {
+	items := []structSliceItem{{Name: "a", Count: 1}, {Name: "b"}}
+	items[1].Inner.Tag = "t"
+	generic := []interface{}{items[0], items[1]}
+
+	data, err := bson.Marshal(bson.M{"items": items})
+	c.Assert(err, IsNil)
+	expected, err := bson.Marshal(bson.M{"items": generic})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, string(expected))
+
+	var out struct{ Items []structSliceItem }
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.Items, Equals, items)
+
+	// Errors still report the path of the failing element.
+	_, err = bson.Marshal(bson.M{"v": []struct{ C chan int }{{}}})
+	c.Assert(err, Matches, `field "v.0.c": Can't marshal chan int: .*`)
+}
+
+func structSliceDoc(n int, generic bool) bson.M {
+	items := make([]structSliceItem, n)
+	for i := range items {
+		items[i] = structSliceItem{Name: "item", Count: i}
+	}
+	if !generic {
+		return bson.M{"items": items}
+	}
+	values := make([]interface{}, n)
+	for i := range items {
+		values[i] = items[i]
+	}
+	return bson.M{"items": values}
+}
+
+func (s *S) BenchmarkMarshalStructSlice(c *C) {
+	doc := structSliceDoc(10000, false)
+	for i := 0; i < c.N; i++ {
+		bson.Marshal(doc)
+	}
+}
+
+func (s *S) BenchmarkMarshalInterfaceSlice(c *C) {
+	doc := structSliceDoc(10000, true)
+	for i := 0; i < c.N; i++ {
+		bson.Marshal(doc)
+	}
+}
+
 func (s *S) TestUnmarshalSampleItems(c *C) {
 	for i, item := range sampleItems {
 		value := bson.M{}
@@ -114,6 +674,161 @@ func (s *S) TestUnmarshalSampleItems(c *C) {
 	}
 }
 
+func (s *S) TestUnmarshalArray(c *C) {
+	data, err := bson.Marshal(bson.D{{"0", 1}, {"1", "x"}, {"2", 3}})
+	c.Assert(err, IsNil)
+
+	var indexes []int
+	var values []interface{}
+	err = bson.UnmarshalArray(data, reflect.TypeOf(0), func(i int, v interface{}) os.Error {
+		indexes = append(indexes, i)
+		values = append(values, v)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(indexes, Equals, []int{0, 2})
+	c.Assert(values, Equals, []interface{}{1, 3})
+
+	values = nil
+	err = bson.UnmarshalArray(data, reflect.TypeOf(values).Elem(), func(i int, v interface{}) os.Error {
+		values = append(values, v)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(values, Equals, []interface{}{1, "x", 3})
+}
+
+func (s *S) TestUnmarshalAll(c *C) {
+	var data []byte
+	for i := 1; i <= 3; i++ {
+		doc, err := bson.Marshal(bson.M{"n": i})
+		c.Assert(err, IsNil)
+		data = append(data, doc...)
+	}
+
+	var ms []bson.M
+	c.Assert(bson.UnmarshalAll(data, &ms), IsNil)
+	c.Assert(ms, Equals, []bson.M{{"n": 1}, {"n": 2}, {"n": 3}})
+
+	type T struct{ N int }
+	ts := []T{{0}}
+	c.Assert(bson.UnmarshalAll(data, &ts), IsNil)
+	c.Assert(ts, Equals, []T{{0}, {1}, {2}, {3}})
+
+	var ps []*T
+	c.Assert(bson.UnmarshalAll(data, &ps), IsNil)
+	c.Assert(len(ps), Equals, 3)
+	c.Assert(*ps[2], Equals, T{3})
+
+	var empty []bson.M
+	c.Assert(bson.UnmarshalAll(nil, &empty), IsNil)
+	c.Assert(len(empty), Equals, 0)
+}
+
+func (s *S) TestUnmarshalAllErrors(c *C) {
+	data, err := bson.Marshal(bson.M{"n": 1})
+	c.Assert(err, IsNil)
+
+	truncated := data[:len(data)-1]
+	garbage := append(append([]byte{}, data...), 0, 0)
+	partial := append(append([]byte{}, data...), data[:6]...)
+	for _, bad := range [][]byte{truncated, garbage, partial} {
+		var ms []bson.M
+		err = bson.UnmarshalAll(bad, &ms)
+		c.Assert(err == bson.ErrTruncated, Equals, true)
+	}
+
+	err = bson.UnmarshalAll(data, []bson.M{})
+	c.Assert(err, Matches, "UnmarshalAll needs a pointer to a slice.")
+}
+
+func (s *S) TestUnmarshalArrayStopsOnError(c *C) {
+	data, err := bson.Marshal(bson.D{{"0", 1}, {"1", 2}, {"2", 3}})
+	c.Assert(err, IsNil)
+
+	calls := 0
+	err = bson.UnmarshalArray(data, reflect.TypeOf(0), func(i int, v interface{}) os.Error {
+		calls++
+		if i == 1 {
+			return os.ErrorString("stop")
+		}
+		return nil
+	})
+	c.Assert(err, Matches, "stop")
+	c.Assert(calls, Equals, 2)
+}
+
+func (s *S) TestUnmarshalArrayNotArray(c *C) {
+	data, err := bson.Marshal(bson.D{{"0", 1}, {"a", 2}})
+	c.Assert(err, IsNil)
+
+	calls := 0
+	err = bson.UnmarshalArray(data, reflect.TypeOf(0), func(i int, v interface{}) os.Error {
+		calls++
+		return nil
+	})
+	c.Assert(err, Matches, `Data is not a BSON array: found key "a" at index 1`)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *S) TestUnmarshalUndefined(c *C) {
+	data := wrapInDoc("\x06u\x00")
+
+	m := bson.M{}
+	c.Assert(bson.Unmarshal([]byte(data), m), IsNil)
+	c.Assert(m["u"], Equals, bson.Undefined)
+
+	var doc struct{ U interface{} }
+	c.Assert(bson.Unmarshal([]byte(data), &doc), IsNil)
+	c.Assert(doc.U, Equals, bson.Undefined)
+
+	var d bson.D
+	c.Assert(bson.Unmarshal([]byte(data), &d), IsNil)
+	c.Assert(d, Equals, bson.D{{"u", bson.Undefined}})
+
+	for _, v := range []interface{}{m, &doc, d} {
+		out, err := bson.Marshal(v)
+		c.Assert(err, IsNil)
+		c.Assert(string(out), Equals, data)
+	}
+}
+
+func (s *S) TestUnmarshalSymbol(c *C) {
+	data := wrapInDoc("\x0Es\x00\x04\x00\x00\x00sym\x00")
+
+	var str struct{ S string }
+	err := bson.Unmarshal([]byte(data), &str)
+	c.Assert(err, IsNil)
+	c.Assert(str.S, Equals, "sym")
+
+	var sym struct{ S bson.Symbol }
+	err = bson.Unmarshal([]byte(data), &sym)
+	c.Assert(err, IsNil)
+	c.Assert(sym.S, Equals, bson.Symbol("sym"))
+
+	m := bson.M{}
+	err = bson.Unmarshal([]byte(data), m)
+	c.Assert(err, IsNil)
+	c.Assert(m["s"], Equals, bson.Symbol("sym"))
+
+	// The symbol kind is preserved on the way back.
+	for _, v := range []interface{}{m, &sym} {
+		out, err := bson.Marshal(v)
+		c.Assert(err, IsNil)
+		c.Assert(string(out), Equals, data)
+	}
+}
+
+func (s *S) TestMarshalStructFieldOrder(c *C) {
+	data, err := bson.Marshal(&inlineMiddle{1, inlineStruct{inlineBase{2, "b"}, 3}, 4})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x10z\x00\x01\x00\x00\x00"+
+		"\x10a\x00\x02\x00\x00\x00"+
+		"\x02bee\x00\x02\x00\x00\x00b\x00"+
+		"\x10c\x00\x03\x00\x00\x00"+
+		"\x10y\x00\x04\x00\x00\x00"))
+}
+
 // --------------------------------------------------------------------------
 // Every type, ordered by the type flag. These are not wrapped with the
 // length and last \x00 from the document. wrapInDoc() computes them.
@@ -148,8 +863,8 @@ var allItems = []testItemType{
 		"\x09_\x00\x02\x01\x00\x00\x00\x00\x00\x00"},
 	{bson.M{"_": nil},
 		"\x0A_\x00"},
-	{bson.M{"_": bson.RegEx{"ab", "cd"}},
-		"\x0B_\x00ab\x00cd\x00"},
+	{bson.M{"_": bson.RegEx{"ab", "im"}},
+		"\x0B_\x00ab\x00im\x00"},
 	{bson.M{"_": bson.JS{"code", nil}},
 		"\x0D_\x00\x05\x00\x00\x00code\x00"},
 	{bson.M{"_": bson.Symbol("sym")},
@@ -165,12 +880,43 @@ var allItems = []testItemType{
 		"\x12_\x00\x02\x01\x00\x00\x00\x00\x00\x00"},
 	{bson.M{"_": int64(258 << 32)},
 		"\x12_\x00\x00\x00\x00\x00\x02\x01\x00\x00"},
+	{bson.M{"_": bson.DBPointer{"db.c", bson.ObjectId("0123456789ab")}},
+		"\x0C_\x00\x05\x00\x00\x00db.c\x000123456789ab"},
+	{bson.M{"_": parseDecimal128("0.001")},
+		"\x13_\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x3a\x30"},
 	{bson.M{"_": bson.MaxKey},
 		"\x7F_\x00"},
 	{bson.M{"_": bson.MinKey},
 		"\xFF_\x00"},
 }
 
+func (s *S) TestUnmarshalAllItemsIntoInterface(c *C) {
+	for i, item := range allItems {
+		var v interface{}
+		err := bson.Unmarshal([]byte(wrapInDoc(item.data)), &v)
+		c.Assert(err, IsNil)
+		c.Assert(v, Equals, item.obj, Bug("Failed on item %d", i))
+
+		// The same types are used for array elements.
+		if item.data == "" {
+			continue
+		}
+		var a struct{ A []interface{} }
+		data := "\x04a\x00" + wrapInDoc(item.data[:1]+"0"+item.data[2:])
+		err = bson.Unmarshal([]byte(wrapInDoc(data)), &a)
+		c.Assert(err, IsNil)
+		c.Assert(a.A, Equals, []interface{}{item.obj.(bson.M)["_"]}, Bug("Failed on item %d", i))
+	}
+}
+
+func parseDecimal128(s string) bson.Decimal128 {
+	d, err := bson.ParseDecimal128(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
 func (s *S) TestMarshalAllItems(c *C) {
 	for i, item := range allItems {
 		data, err := bson.Marshal(item.obj)
@@ -212,23 +958,194 @@ func (s *S) TestUnmarshalRawIncompatible(c *C) {
 	c.Assert(err, Matches, `BSON kind 0x08 isn't compatible with type \*struct { }`)
 }
 
+func (s *S) TestRawLookup(c *C) {
+	data, err := bson.Marshal(bson.D{{"_type", "circle"}, {"radius", 2.5}, {"tags", []string{"a"}}})
+	c.Assert(err, IsNil)
+	var raw bson.Raw
+	err = bson.Unmarshal(data, &raw)
+	c.Assert(err, IsNil)
+
+	elem, ok := raw.Lookup("_type")
+	c.Assert(ok, Equals, true)
+	c.Assert(elem, Equals, bson.Raw{0x02, []byte("\x07\x00\x00\x00circle\x00")})
+	var kind string
+	c.Assert(elem.Unmarshal(&kind), IsNil)
+	c.Assert(kind, Equals, "circle")
+
+	elem, ok = raw.Lookup("tags")
+	c.Assert(ok, Equals, true)
+	c.Assert(elem.Kind, Equals, byte(0x04))
+
+	elem, ok = raw.Lookup("missing")
+	c.Assert(ok, Equals, false)
+	c.Assert(elem, Equals, bson.Raw{})
+}
+
+func (s *S) TestKindConstants(c *C) {
+	data, err := bson.Marshal(bson.M{"a": bson.M{"b": []int{1}}})
+	c.Assert(err, IsNil)
+	var raw bson.Raw
+	c.Assert(bson.Unmarshal(data, &raw), IsNil)
+	c.Assert(raw.Kind, Equals, bson.KindDocument)
+	a, _ := raw.Lookup("a")
+	c.Assert(a.Kind, Equals, bson.KindDocument)
+	b, _ := a.Lookup("b")
+	c.Assert(b.Kind, Equals, bson.KindArray)
+	i, _ := b.Lookup("0")
+	c.Assert(i.Kind, Equals, bson.KindInt32)
+}
+
+func (s *S) TestRawLookupNotDocument(c *C) {
+	_, ok := bson.Raw{0x08, []byte{0x01}}.Lookup("a")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestRawLookupCorrupted(c *C) {
+	_, ok := bson.Raw{0x03, []byte("\x10\x00\x00\x00\x08a\x00")}.Lookup("a")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestRawToD(c *C) {
+	doc := bson.D{
+		{"b", 1},
+		{"a", bson.D{{"z", 1}, {"y", "2"}}},
+		{"c", []interface{}{bson.D{{"q", true}, {"p", nil}}, "x"}},
+	}
+	data, err := bson.Marshal(doc)
+	c.Assert(err, IsNil)
+
+	for _, kind := range []byte{0x00, 0x03} {
+		result, err := bson.Raw{kind, data}.ToD()
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, doc)
+	}
+
+	result, err := bson.Raw{0x03, data[:len(data)-1]}.ToD()
+	c.Assert(err, Matches, "Document is truncated")
+	c.Assert(result, IsNil)
+
+	_, err = bson.Raw{0x02, []byte("\x02\x00\x00\x00a\x00")}.ToD()
+	c.Assert(err, Matches, "BSON kind 0x02 isn't compatible with type bson.D")
+}
+
+func (s *S) TestUnmarshalMapOfRaw(c *C) {
+	data, err := bson.Marshal(bson.D{{"a", 1}, {"b", bson.D{{"c", "x"}}}, {"d", []int{2}}, {"n", nil}})
+	c.Assert(err, IsNil)
+
+	m := map[string]bson.Raw{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(len(m), Equals, 4)
+	c.Assert(m["a"], Equals, bson.Raw{0x10, []byte("\x01\x00\x00\x00")})
+	c.Assert(m["b"].Kind, Equals, byte(0x03))
+	c.Assert(string(m["b"].Data), Equals, wrapInDoc("\x02c\x00\x02\x00\x00\x00x\x00"))
+	c.Assert(m["d"].Kind, Equals, byte(0x04))
+	c.Assert(m["n"], Equals, bson.Raw{0x0A, []byte{}})
+
+	var sub struct{ C string }
+	c.Assert(m["b"].Unmarshal(&sub), IsNil)
+	c.Assert(sub.C, Equals, "x")
+
+	// Corrupted elements are still reported.
+	m = map[string]bson.Raw{}
+	err = bson.Unmarshal([]byte(wrapInDoc("\x03b\x00\x06\x00\x00\x00\x00")), m)
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestRawMap(c *C) {
+	data, err := bson.Marshal(bson.D{{"b", 1}, {"a", bson.D{{"z", 1}}}, {"c", []int{2}}})
+	c.Assert(err, IsNil)
+
+	for _, kind := range []byte{0x00, 0x03} {
+		m, err := bson.Raw{kind, data}.Map()
+		c.Assert(err, IsNil)
+		c.Assert(m, Equals, bson.M{"b": 1, "a": bson.M{"z": 1}, "c": []interface{}{2}})
+	}
+
+	m, err := bson.Raw{0x03, data[:len(data)-1]}.Map()
+	c.Assert(err, Matches, "Document is truncated")
+	c.Assert(m, IsNil)
+
+	_, err = bson.Raw{0x02, []byte("\x02\x00\x00\x00a\x00")}.Map()
+	c.Assert(err, Matches, "BSON kind 0x02 isn't compatible with type bson.M")
+}
+
+// --------------------------------------------------------------------------
+// Validation tests.
+
+func (s *S) TestDocumentLength(c *C) {
+	data, err := bson.Marshal(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+	l, err := bson.DocumentLength(data)
+	c.Assert(err, IsNil)
+	c.Assert(l, Equals, len(data))
+
+	l, err = bson.DocumentLength(append(append([]byte{}, data...), data...))
+	c.Assert(err, IsNil)
+	c.Assert(l, Equals, len(data))
+
+	_, err = bson.DocumentLength(data[:4])
+	c.Assert(err, Matches, `Document needs at least 5 bytes \(got 4\)`)
+	_, err = bson.DocumentLength(data[:len(data)-1])
+	c.Assert(err, Matches, "Document length 12 exceeds the 11 bytes available")
+	_, err = bson.DocumentLength([]byte("\x04\x00\x00\x00\x00"))
+	c.Assert(err, Matches, "Document is corrupted")
+	_, err = bson.DocumentLength([]byte("\xff\xff\xff\xff\x00"))
+	c.Assert(err, Matches, "Document is corrupted")
+}
+
+func (s *S) TestValidateAllItems(c *C) {
+	for i, item := range allItems {
+		err := bson.Validate([]byte(wrapInDoc(item.data)))
+		c.Assert(err, IsNil, Bug("Failed on item %d: %#v", i, item))
+	}
+	for i, item := range sampleItems {
+		err := bson.Validate([]byte(item.data))
+		c.Assert(err, IsNil, Bug("Failed on item %d: %#v", i, item))
+	}
+}
+
+var validateErrorItems = []struct{ data, err string }{
+	{"", "Document is truncated"},
+	{wrapInDoc("\x02a\x00\x03\x00\x00\x00ab"), "Document is corrupted"},
+	{wrapInDoc("\x02a\x00\x03\x00\x00\x00abc"), "Document is corrupted"},
+	{wrapInDoc("\x08a\x00\x02"), "Document is corrupted"},
+	{wrapInDoc("\x05a\x00\x03\x00\x00\x00\x02abc"), "Document is corrupted"},
+	{wrapInDoc("\x05a\x00\x07\x00\x00\x00\x02\x04\x00\x00\x00old"), "Document is corrupted"},
+	{wrapInDoc("\x03a\x00\x06\x00\x00\x00\x00"), "Document is corrupted"},
+	{wrapInDoc("\x20a\x00"), `Unknown element kind \(0x20\)`},
+	{wrapInDoc("\x10a\x00\x01\x00\x00\x00") + "\x00", "Document is corrupted"},
+}
+
+func (s *S) TestValidateErrorItems(c *C) {
+	for i, item := range validateErrorItems {
+		err := bson.Validate([]byte(item.data))
+		c.Assert(err, Matches, item.err, Bug("Failed on item %d: %q", i, item.data))
+	}
+}
+
 // --------------------------------------------------------------------------
 // Some one way marshaling operations which would unmarshal differently.
 
+type Hash []byte
+
 var oneWayMarshalItems = []testItemType{
 	// These are being passed as pointers, and will unmarshal as values.
 	{bson.M{"": &bson.Binary{0x02, []byte("old")}},
 		"\x05\x00\x07\x00\x00\x00\x02\x03\x00\x00\x00old"},
 	{bson.M{"": &bson.Binary{0x80, []byte("udef")}},
 		"\x05\x00\x04\x00\x00\x00\x80udef"},
-	{bson.M{"": &bson.RegEx{"ab", "cd"}},
-		"\x0B\x00ab\x00cd\x00"},
+	{bson.M{"": &bson.RegEx{"ab", "im"}},
+		"\x0B\x00ab\x00im\x00"},
 	{bson.M{"": &bson.JS{"code", nil}},
 		"\x0D\x00\x05\x00\x00\x00code\x00"},
 	{bson.M{"": &bson.JS{"code", bson.M{"": nil}}},
 		"\x0F\x00\x14\x00\x00\x00\x05\x00\x00\x00code\x00" +
 			"\x07\x00\x00\x00\x0A\x00\x00"},
 
+	// Options are sorted when marshaled.
+	{bson.M{"": bson.RegEx{"ab", "xmi"}},
+		"\x0B\x00ab\x00imx\x00"},
+
 	// There's no float32 type in BSON.  Will encode as a float64.
 	{bson.M{"": float32(5.05)},
 		"\x01\x00\x00\x00\x00@33\x14@"},
@@ -244,6 +1161,8 @@ var oneWayMarshalItems = []testItemType{
 	// Will unmarshal as a []byte.
 	{bson.M{"": bson.Binary{0x00, []byte("yo")}},
 		"\x05\x00\x02\x00\x00\x00\x00yo"},
+	{bson.M{"": Hash("yo")},
+		"\x05\x00\x02\x00\x00\x00\x00yo"},
 
 	// No way to preserve the type information here. We might encode as a zero
 	// value, but this would mean that pointer values in structs wouldn't be
@@ -269,6 +1188,14 @@ var oneWayMarshalItems = []testItemType{
 	{bson.M{"": int32(258)},
 		"\x10\x00\x02\x01\x00\x00"},
 
+	// Always an int64, even if it would fit an int32.  Will unmarshal as int64.
+	{bson.M{"": bson.Int64(258)},
+		"\x12\x00\x02\x01\x00\x00\x00\x00\x00\x00"},
+	{&struct {
+		V bson.Int64 "/s"
+	}{258},
+		"\x12v\x00\x02\x01\x00\x00\x00\x00\x00\x00"},
+
 	// That's a special case. The unsigned value is too large for an int32,
 	// so an int64 is used instead.
 	{bson.M{"": uint32(1<<32 - 1)},
@@ -352,6 +1279,16 @@ var structItems = []testItemType{
 	}{&struct{ Byte byte }{8}},
 		"\x03v\x00" + "\x0f\x00\x00\x00\x10byte\x00\b\x00\x00\x00\x00"},
 	{&struct{ priv byte }{}, ""},
+	{&struct {
+		priv byte
+		Byte byte
+	}{0, 8},
+		"\x10byte\x00\x08\x00\x00\x00"},
+	{&struct {
+		Skip byte "-"
+		Byte byte
+	}{0, 8},
+		"\x10byte\x00\x08\x00\x00\x00"},
 
 	// The order of the dumped fields should be the same in the struct.
 	{&struct{ A, C, B, D, F, E *byte }{},
@@ -421,6 +1358,12 @@ var unmarshalItems = []testItemType{
 	{&struct{ priv byte }{},
 		"\x10priv\x00\x08\x00\x00\x00"},
 
+	// Field is excluded.  Should not attempt to unmarshal it.
+	{&struct {
+		Skip byte "-"
+	}{},
+		"\x10skip\x00\x08\x00\x00\x00" + "\x10-\x00\x08\x00\x00\x00"},
+
 	// Wrong casing. Field names are lowercased.
 	{&struct{ Byte byte }{},
 		"\x10Byte\x00\x08\x00\x00\x00"},
@@ -460,6 +1403,304 @@ func (s *S) TestUnmarshalOneWayItems(c *C) {
 	}
 }
 
+type aliasDoc struct {
+	Name  string "name,alias=fullname,alias=n"
+	Other int
+}
+
+type conventionalTagDoc struct {
+	A int    `json:"jsonA" bson:"bsonA"`
+	B string `json:"b" bson:",omitempty"`
+	C int    `json:"c" db:"c"`
+	D int    `bson:"-"`
+	E int    "legacy/c"
+}
+
+func (s *S) TestConventionalTags(c *C) {
+	data, err := bson.Marshal(&conventionalTagDoc{1, "", 2, 3, 4})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc(
+		"\x10bsonA\x00\x01\x00\x00\x00"+
+			"\x10c\x00\x02\x00\x00\x00"+
+			"\x10legacy\x00\x04\x00\x00\x00"))
+
+	var out conventionalTagDoc
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out, Equals, conventionalTagDoc{1, "", 2, 0, 4})
+}
+
+func (s *S) TestUnmarshalAliases(c *C) {
+	var out aliasDoc
+	err := bson.Unmarshal([]byte(wrapInDoc("\x02fullname\x00\x04\x00\x00\x00Bob\x00")), &out)
+	c.Assert(err, IsNil)
+	c.Assert(out.Name, Equals, "Bob")
+
+	// The primary key and earlier aliases win whatever their position.
+	for _, d := range []bson.D{
+		{{"n", "c"}, {"name", "a"}, {"fullname", "b"}},
+		{{"name", "a"}, {"n", "c"}, {"fullname", "b"}},
+	} {
+		data, err := bson.Marshal(d)
+		c.Assert(err, IsNil)
+		out = aliasDoc{}
+		c.Assert(bson.UnmarshalStrict(data, &out), IsNil)
+		c.Assert(out.Name, Equals, "a")
+	}
+	data, _ := bson.Marshal(bson.D{{"n", "c"}, {"fullname", "b"}})
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.Name, Equals, "b")
+
+	// Marshaling always uses the primary key.
+	data, err = bson.Marshal(&aliasDoc{Name: "a"})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x02name\x00\x02\x00\x00\x00a\x00\x10other\x00\x00\x00\x00\x00"))
+}
+
+func (s *S) TestUnmarshalReset(c *C) {
+	type T struct {
+		A, B int
+		C    []string
+	}
+	first, _ := bson.Marshal(bson.M{"a": 1, "b": 2, "c": []string{"x"}})
+	second, _ := bson.Marshal(bson.M{"a": 3})
+
+	var out T
+	c.Assert(bson.Unmarshal(first, &out), IsNil)
+	c.Assert(bson.Unmarshal(second, &out), IsNil)
+	c.Assert(out.B, Equals, 2)
+
+	c.Assert(bson.UnmarshalReset(first, &out), IsNil)
+	c.Assert(bson.UnmarshalReset(second, &out), IsNil)
+	c.Assert(out.A, Equals, 3)
+	c.Assert(out.B, Equals, 0)
+	c.Assert(out.C, IsNil)
+
+	m := bson.M{"b": 2}
+	c.Assert(bson.UnmarshalReset(second, m), IsNil)
+	c.Assert(m, Equals, bson.M{"a": 3})
+
+	var iface interface{}
+	c.Assert(bson.UnmarshalReset(first, &iface), IsNil)
+	c.Assert(bson.UnmarshalReset(second, &iface), IsNil)
+	c.Assert(iface, Equals, bson.M{"a": 3})
+}
+
+func (s *S) TestUnmarshalStrict(c *C) {
+	data, err := bson.Marshal(bson.M{"a": 1, "b": bson.M{"c": 2}})
+	c.Assert(err, IsNil)
+
+	var ok struct {
+		A int
+		B struct{ C int }
+	}
+	err = bson.UnmarshalStrict(data, &ok)
+	c.Assert(err, IsNil)
+	c.Assert(ok.A, Equals, 1)
+	c.Assert(ok.B.C, Equals, 2)
+
+	var unknown struct{ A int }
+	err = bson.UnmarshalStrict(data, &unknown)
+	c.Assert(err, Matches, `Document key "b" has no matching field in struct { A int }`)
+
+	var nested struct {
+		A int
+		B struct{ D int }
+	}
+	err = bson.UnmarshalStrict(data, &nested)
+	c.Assert(err, Matches, `Document key "c" has no matching field in struct { D int }`)
+
+	m := bson.M{}
+	err = bson.UnmarshalStrict(data, m)
+	c.Assert(err, IsNil)
+	c.Assert(m["a"], Equals, 1)
+}
+
+var numericBoundaryItems = []struct {
+	value interface{}
+	out   interface{}
+	fits  bool
+}{
+	{127, &struct{ V int8 }{}, true},
+	{128, &struct{ V int8 }{}, false},
+	{-128, &struct{ V int8 }{}, true},
+	{-129, &struct{ V int8 }{}, false},
+	{32767, &struct{ V int16 }{}, true},
+	{32768, &struct{ V int16 }{}, false},
+	{-32768, &struct{ V int16 }{}, true},
+	{-32769, &struct{ V int16 }{}, false},
+	{int64(math.MaxInt32), &struct{ V int32 }{}, true},
+	{int64(math.MaxInt32 + 1), &struct{ V int32 }{}, false},
+	{int64(math.MinInt32), &struct{ V int32 }{}, true},
+	{int64(math.MinInt32 - 1), &struct{ V int32 }{}, false},
+	{int64(math.MaxInt64), &struct{ V int64 }{}, true},
+	{int64(math.MinInt64), &struct{ V int64 }{}, true},
+	{255, &struct{ V uint8 }{}, true},
+	{256, &struct{ V uint8 }{}, false},
+	{-1, &struct{ V uint8 }{}, false},
+	{65535, &struct{ V uint16 }{}, true},
+	{65536, &struct{ V uint16 }{}, false},
+	{int64(math.MaxUint32), &struct{ V uint32 }{}, true},
+	{int64(math.MaxUint32 + 1), &struct{ V uint32 }{}, false},
+	{int64(math.MaxInt64), &struct{ V uint64 }{}, true},
+	{int64(-1), &struct{ V uint64 }{}, false},
+	{127.0, &struct{ V int8 }{}, true},
+	{128.0, &struct{ V int8 }{}, false},
+	{-9223372036854775808.0, &struct{ V int64 }{}, true},
+	{9223372036854775808.0, &struct{ V int64 }{}, false},
+	{math.NaN(), &struct{ V int64 }{}, false},
+	{255.0, &struct{ V uint8 }{}, true},
+	{-1.0, &struct{ V uint }{}, false},
+	{1.5, &struct{ V float32 }{}, true},
+	{1e300, &struct{ V float32 }{}, false},
+}
+
+func numericValue(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+func (s *S) TestUnmarshalNumericBoundaries(c *C) {
+	for i, item := range numericBoundaryItems {
+		data, err := bson.Marshal(bson.M{"v": item.value})
+		c.Assert(err, IsNil)
+		t := reflect.TypeOf(item.out).Elem()
+
+		out := reflect.New(t)
+		err = bson.Unmarshal(data, out.Interface())
+		c.Assert(err, IsNil)
+		v := out.Elem().Field(0)
+		if item.fits {
+			c.Assert(numericValue(v), Equals, numericValue(reflect.ValueOf(item.value)),
+				Bug("Failed on item %d", i))
+		} else {
+			c.Assert(numericValue(v), Equals, 0.0, Bug("Failed on item %d", i))
+		}
+
+		out = reflect.New(t)
+		err = bson.UnmarshalStrict(data, out.Interface())
+		if item.fits {
+			c.Assert(err, IsNil, Bug("Failed on item %d", i))
+		} else {
+			c.Assert(err, Matches, "BSON kind 0x.. isn't compatible with type "+t.Field(0).Type.String(),
+				Bug("Failed on item %d", i))
+		}
+	}
+}
+
+func (s *S) TestUnmarshalDuplicatedKeys(c *C) {
+	data := []byte(wrapInDoc("\x10a\x00\x01\x00\x00\x00\x10a\x00\x02\x00\x00\x00"))
+
+	m := bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m, Equals, bson.M{"a": 2})
+
+	var doc struct{ A int }
+	c.Assert(bson.Unmarshal(data, &doc), IsNil)
+	c.Assert(doc.A, Equals, 2)
+
+	var d bson.D
+	c.Assert(bson.Unmarshal(data, &d), IsNil)
+	c.Assert(d, Equals, bson.D{{"a", 1}, {"a", 2}})
+
+	err := bson.UnmarshalStrict(data, bson.M{})
+	c.Assert(err, Matches, `Duplicated key "a" in document`)
+	err = bson.UnmarshalStrict(data, &doc)
+	c.Assert(err, Matches, `Duplicated key "a" in document`)
+}
+
+func (s *S) TestUnmarshalMaxDocumentSize(c *C) {
+	defer func(size int) { bson.MaxDocumentSize = size }(bson.MaxDocumentSize)
+	data, err := bson.Marshal(bson.M{"a": bson.M{"b": "hello"}})
+	c.Assert(err, IsNil)
+
+	bson.MaxDocumentSize = len(data)
+	err = bson.Unmarshal(data, bson.M{})
+	c.Assert(err, IsNil)
+
+	bson.MaxDocumentSize = len(data) - 1
+	err = bson.Unmarshal(data, bson.M{})
+	c.Assert(err, Matches, "Document size 26 exceeds the maximum of 25 bytes")
+
+	// Nested documents are verified as well.
+	nested := []byte(wrapInDoc("\x03a\x00\xff\xff\xff\x7f\x00"))
+	bson.MaxDocumentSize = len(nested)
+	err = bson.Unmarshal(nested, bson.M{})
+	c.Assert(err, Matches, "Document size 2147483647 exceeds the maximum of 13 bytes")
+}
+
+// nestedDoc returns a document holding depth documents and arrays nested
+// within each other, including the outer document.
+func nestedDoc(depth int) []byte {
+	doc := wrapInDoc("")
+	for i := 1; i < depth; i++ {
+		if i%2 == 0 {
+			doc = wrapInDoc("\x030\x00" + doc)
+		} else {
+			doc = wrapInDoc("\x040\x00" + doc)
+		}
+	}
+	return []byte(doc)
+}
+
+func (s *S) TestUnmarshalMaxDocumentDepth(c *C) {
+	c.Assert(bson.MaxDocumentDepth, Equals, 100)
+	c.Assert(bson.Unmarshal(nestedDoc(100), bson.M{}), IsNil)
+	c.Assert(bson.Validate(nestedDoc(100)), IsNil)
+
+	err := bson.Unmarshal(nestedDoc(101), bson.M{})
+	c.Assert(err, Matches, "Document nesting exceeds the maximum depth of 100")
+	var d bson.D
+	err = bson.Unmarshal(nestedDoc(101), &d)
+	c.Assert(err, Matches, "Document nesting exceeds the maximum depth of 100")
+	err = bson.Validate(nestedDoc(101))
+	c.Assert(err, Matches, "Document nesting exceeds the maximum depth of 100")
+
+	defer func(depth int) { bson.MaxDocumentDepth = depth }(bson.MaxDocumentDepth)
+	bson.MaxDocumentDepth = 3
+	c.Assert(bson.Unmarshal(nestedDoc(3), bson.M{}), IsNil)
+	err = bson.Unmarshal(nestedDoc(4), bson.M{})
+	c.Assert(err, Matches, "Document nesting exceeds the maximum depth of 3")
+
+	// Sibling documents don't add up.
+	data, err := bson.Marshal(bson.M{"a": bson.M{"b": bson.M{}}, "c": bson.M{"d": bson.M{}}})
+	c.Assert(err, IsNil)
+	c.Assert(bson.Unmarshal(data, bson.M{}), IsNil)
+}
+
+func (s *S) TestUnmarshalNegativeLength(c *C) {
+	err := bson.Unmarshal([]byte(wrapInDoc("\x03a\x00\xfb\xff\xff\xff\x00")), bson.M{})
+	c.Assert(err, Matches, "Document is corrupted")
+	err = bson.Unmarshal([]byte(wrapInDoc("\x02a\x00\xfb\xff\xff\xff\x00")), bson.M{})
+	c.Assert(err, Matches, "Document is corrupted")
+}
+
+func (s *S) TestMarshalConditionalObjectIdAndTime(c *C) {
+	items := []struct {
+		obj   interface{}
+		empty bool
+	}{
+		{&condObjectId{}, true},
+		{&condObjectId{bson.ZeroObjectId}, true},
+		{&condObjectId{bson.ObjectIdHex("4d88e15b60f486e428412dc9")}, false},
+		{&condTime{}, true},
+		{&condTime{time.Unix(0, 0)}, false},
+		{&condTime{time.Date(2011, 5, 24, 10, 20, 30, 0, time.UTC)}, false},
+	}
+	for i, item := range items {
+		data, err := bson.Marshal(item.obj)
+		c.Assert(err, IsNil)
+		m := bson.M{}
+		c.Assert(bson.Unmarshal(data, m), IsNil)
+		_, found := m["v"]
+		c.Assert(found, Equals, !item.empty, Bug("Failed on item %d", i))
+	}
+}
+
 func (s *S) TestUnmarshalNilInStruct(c *C) {
 	// Nil is the default value, so we need to ensure it's indeed being set.
 	b := byte(1)
@@ -469,6 +1710,26 @@ func (s *S) TestUnmarshalNilInStruct(c *C) {
 	c.Assert(v, Equals, &struct{ Ptr *byte }{nil})
 }
 
+func (s *S) TestUnmarshalNullIntoPtrToPtr(c *C) {
+	// Explicit null initializes the outer pointer only.
+	v := &struct{ Ptr **byte }{}
+	err := bson.Unmarshal([]byte(wrapInDoc("\x0Aptr\x00")), v)
+	c.Assert(err, IsNil)
+	c.Assert(v.Ptr, NotNil)
+	c.Assert(*v.Ptr, IsNil)
+
+	// Missing value leaves it untouched.
+	v = &struct{ Ptr **byte }{}
+	err = bson.Unmarshal([]byte(wrapInDoc("")), v)
+	c.Assert(err, IsNil)
+	c.Assert(v.Ptr, IsNil)
+
+	// And it marshals back as null.
+	data, err := bson.Marshal(&struct{ Ptr **byte }{new(*byte)})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x0Aptr\x00"))
+}
+
 // --------------------------------------------------------------------------
 // Marshalling error cases.
 
@@ -477,19 +1738,67 @@ type structWithDupKeys struct {
 	Other byte "name" // Tag should precede.
 }
 
+type structWithBadFlag struct {
+	V int "v,bogus"
+}
+
+type structWithInlineDupKeys struct {
+	Name  byte
+	Other struct{ Name byte } ",inline"
+}
+
+type structWithBadInline struct {
+	V int ",inline"
+}
+
+type structWithAliasDupKeys struct {
+	Name  byte
+	Other byte "other,alias=name"
+}
+
 var marshalErrorItems = []testItemType{
 	{bson.M{"": uint64(1 << 63)},
-		"BSON has no uint64 type, and value is too large to fit correctly in an int64"},
+		`field "": BSON has no uint64 type, and value is too large to fit correctly in an int64`},
 	{bson.M{"": bson.ObjectId("tooshort")},
-		"ObjectIDs must be exactly 12 bytes long \\(got 8\\)"},
+		`field "": ObjectIDs must be exactly 12 bytes long \(got 8\)`},
 	{int64(123),
 		"Can't marshal int64 as a BSON document"},
 	{bson.M{"": 1i},
-		"Can't marshal complex128 in a BSON document"},
+		`field "": Can't marshal complex128: type has no BSON representation`},
+	{&struct{ C chan int }{},
+		`field "c": Can't marshal chan int: type has no BSON representation`},
+	{&struct{ F func() }{},
+		`field "f": Can't marshal func\(\): type has no BSON representation`},
+	{bson.M{"": []interface{}{1, func() {}}},
+		`field ".1": Can't marshal func\(\): type has no BSON representation`},
+	{nil,
+		"Can't marshal nil as a BSON document"},
+	{(*bson.M)(nil),
+		`Can't marshal nil \*bson.M as a BSON document`},
+	{bson.M{"": bson.DBPointer{"db.c", bson.ObjectId("tooshort")}},
+		`field "": ObjectIDs must be exactly 12 bytes long \(got 8\)`},
+	{bson.M{"": bson.ObjectId("4d88e15b60f486e428412dc9")},
+		`field "": ObjectIDs must be exactly 12 bytes long \(got the 24 bytes long hex representation "4d88e15b60f486e428412dc9"; use ObjectIdHex to convert it\)`},
 	{&structWithDupKeys{},
 		"Duplicated key 'name' in struct bson_test.structWithDupKeys"},
+	{&structWithBadFlag{},
+		"Unsupported field flag: bogus"},
+	{bson.M{"": bson.RegEx{"ab", "iz"}},
+		`field "": Unsupported RegEx option: "z"`},
+	{&structWithInlineDupKeys{},
+		"Duplicated key 'name' in struct bson_test.structWithInlineDupKeys"},
+	{&structWithBadInline{},
+		"Option ,inline needs a struct value field"},
+	{&structWithAliasDupKeys{},
+		"Duplicated key 'name' in struct bson_test.structWithAliasDupKeys"},
 	{bson.Raw{0x0A, []byte{}},
 		"Attempted to unmarshal Raw kind 10 as a document"},
+	{bson.M{"a\x00b": 1},
+		`field "a\\x00b": BSON element name "a\\x00b" contains a NUL byte`},
+	{bson.D{{"a", bson.M{"\x00": true}}},
+		`field "a.\\x00": BSON element name "\\x00" contains a NUL byte`},
+	{bson.M{"": bson.RegEx{"a\x00", ""}},
+		`field "": BSON cstring "a\\x00" contains a NUL byte`},
 }
 
 func (s *S) TestMarshalErrorItems(c *C) {
@@ -500,6 +1809,49 @@ func (s *S) TestMarshalErrorItems(c *C) {
 	}
 }
 
+func (s *S) TestMarshalStringWithNUL(c *C) {
+	data, err := bson.Marshal(bson.M{"s": "a\x00b"})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x02s\x00\x04\x00\x00\x00a\x00b\x00"))
+
+	m := bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m["s"], Equals, "a\x00b")
+}
+
+type pathAddress struct {
+	Zip interface{}
+}
+
+type pathUser struct {
+	Address pathAddress
+	Tags    []interface{}
+}
+
+func (s *S) TestMarshalErrorFieldPath(c *C) {
+	_, err := bson.Marshal(bson.M{"user": &pathUser{Address: pathAddress{1i}}})
+	c.Assert(err, Matches, `field "user.address.zip": Can't marshal complex128: type has no BSON representation`)
+	ferr, ok := err.(*bson.FieldError)
+	c.Assert(ok, Equals, true)
+	c.Assert(ferr.Path, Equals, "user.address.zip")
+	c.Assert(ferr.Err, Matches, "Can't marshal complex128: type has no BSON representation")
+	merr, ok := ferr.Err.(*bson.MarshalError)
+	c.Assert(ok, Equals, true)
+	c.Assert(merr.Type, Equals, reflect.TypeOf(1i))
+	c.Assert(merr.Err == bson.ErrUnsupportedType, Equals, true)
+
+	_, err = bson.Marshal(bson.D{{"user", &pathUser{Tags: []interface{}{"a", 1i}}}})
+	c.Assert(err, Matches, `field "user.tags.1": Can't marshal complex128: type has no BSON representation`)
+
+	// Paths don't leak across calls of a reused encoder.
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	_, err = enc.Marshal(bson.M{"a": bson.M{"b": 1i}})
+	c.Assert(err, Matches, `field "a.b": .*`)
+	_, err = enc.Marshal(bson.M{"c": 1i})
+	c.Assert(err, Matches, `field "c": .*`)
+}
+
 // --------------------------------------------------------------------------
 // Unmarshalling error cases.
 
@@ -516,9 +1868,17 @@ var unmarshalErrorItems = []unmarshalErrorType{
 		"Duplicated key 'name' in struct bson_test.structWithDupKeys"},
 
 	// Non-string map key.
+	{map[float64]interface{}{},
+		"\x10name\x00\x08\x00\x00\x00",
+		"BSON map must have string or integer keys. Got: map\\[float64\\] interface \\{ \\}"},
+
+	// Integer map key which isn't a number.
 	{map[int]interface{}{},
 		"\x10name\x00\x08\x00\x00\x00",
-		"BSON map must have string keys. Got: map\\[int\\] interface \\{ \\}"},
+		`Can't unmarshal document key "name" into map key of type int`},
+	{map[uint8]interface{}{},
+		"\x10256\x00\x08\x00\x00\x00",
+		`Can't unmarshal document key "256" into map key of type uint8`},
 
 	{nil,
 		"\xEEname\x00",
@@ -586,14 +1946,9 @@ func (s *S) TestUnmarshalRawErrorItems(c *C) {
 
 var corruptedData = []string{
 	"\x04\x00\x00\x00\x00",         // Shorter than minimum
-	"\x06\x00\x00\x00\x00",         // Not enough data
-	"\x05\x00\x00",                 // Broken length
 	"\x05\x00\x00\x00\xff",         // Corrupted termination
 	"\x0A\x00\x00\x00\x0Aooop\x00", // Unfinished C string
 
-	// Array end past end of string (s[2]=0x07 is correct)
-	wrapInDoc("\x04\x00\x09\x00\x00\x00\x0A\x00\x00"),
-
 	// Array end within string, but past acceptable.
 	wrapInDoc("\x04\x00\x08\x00\x00\x00\x0A\x00\x00"),
 
@@ -602,6 +1957,12 @@ var corruptedData = []string{
 
 	// String with corrupted end.
 	wrapInDoc("\x02\x00\x03\x00\x00\x00yo\xFF"),
+
+	// Old binary subtype too short for its inner length.
+	wrapInDoc("\x05\x00\x03\x00\x00\x00\x02abc"),
+
+	// Old binary subtype with a mismatching inner length.
+	wrapInDoc("\x05\x00\x07\x00\x00\x00\x02\x04\x00\x00\x00old"),
 }
 
 
@@ -615,6 +1976,25 @@ func (s *S) TestUnmarshalMapDocumentTooShort(c *C) {
 	}
 }
 
+var truncatedData = []string{
+	"",
+	"\x05\x00\x00",         // Broken length
+	"\x06\x00\x00\x00\x00", // Not enough data
+
+	// Array end past end of string (s[2]=0x07 is correct)
+	wrapInDoc("\x04\x00\x09\x00\x00\x00\x0A\x00\x00"),
+}
+
+func (s *S) TestUnmarshalTruncated(c *C) {
+	for i, data := range truncatedData {
+		err := bson.Unmarshal([]byte(data), bson.M{})
+		c.Assert(err == bson.ErrTruncated, Equals, true, Bug("Failed on item %d: %v", i, err))
+
+		err = bson.Unmarshal([]byte(data), &struct{}{})
+		c.Assert(err, Matches, "Document is truncated")
+	}
+}
+
 
 // --------------------------------------------------------------------------
 // Setter test cases.
@@ -660,49 +2040,357 @@ func (s *S) TestUnmarshalAllItemsWithSetter(c *C) {
 				expected = slice
 			}
 
-			c.Assert(obj.Field, NotNil,
-				Bug("Pointer not initialized (%#v)", expected))
-			c.Assert(obj.Field.received, Equals, expected)
-		}
+			c.Assert(obj.Field, NotNil,
+				Bug("Pointer not initialized (%#v)", expected))
+			c.Assert(obj.Field.received, Equals, expected)
+		}
+	}
+}
+
+func (s *S) TestUnmarshalWholeDocumentWithSetter(c *C) {
+	obj := &typeWithSetter{}
+	err := bson.Unmarshal([]byte(sampleItems[0].data), obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.received, Equals, bson.D{{"hello", "world"}})
+}
+
+func (s *S) TestUnmarshalWithFalseSetterIgnoresValue(c *C) {
+	setterResult["2"] = false
+	setterResult["4"] = false
+	defer func() {
+		setterResult["2"] = false, false
+		setterResult["4"] = false, false
+	}()
+
+	m := map[string]*typeWithSetter{}
+	data := wrapInDoc("\x02abc\x00\x02\x00\x00\x001\x00" +
+		"\x02def\x00\x02\x00\x00\x002\x00" +
+		"\x02ghi\x00\x02\x00\x00\x003\x00" +
+		"\x02jkl\x00\x02\x00\x00\x004\x00")
+	err := bson.Unmarshal([]byte(data), m)
+	c.Assert(err, IsNil)
+	c.Assert(m["abc"], NotNil)
+	c.Assert(m["def"], IsNil)
+	c.Assert(m["ghi"], NotNil)
+	c.Assert(m["jkl"], IsNil)
+
+	c.Assert(m["abc"].received, Equals, "1")
+	c.Assert(m["ghi"].received, Equals, "3")
+}
+
+type typeWithSetterError struct {
+	received interface{}
+}
+
+func (o *typeWithSetterError) SetBSON(value interface{}) os.Error {
+	if s, ok := value.(string); ok && s == "bad" {
+		return os.NewError("Bad value")
+	}
+	o.received = value
+	return nil
+}
+
+type docWithSetterErrorField struct {
+	Field *typeWithSetterError "_"
+}
+
+func (s *S) TestUnmarshalWithSetterError(c *C) {
+	obj := &docWithSetterErrorField{}
+	err := bson.Unmarshal([]byte(wrapInDoc("\x02_\x00\x03\x00\x00\x00ok\x00")), obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.Field, NotNil)
+	c.Assert(obj.Field.received, Equals, "ok")
+
+	obj = &docWithSetterErrorField{}
+	err = bson.Unmarshal([]byte(wrapInDoc("\x02_\x00\x04\x00\x00\x00bad\x00")), obj)
+	c.Assert(err, Matches, "Bad value")
+}
+
+func (s *S) TestUnmarshalWholeDocumentWithSetterError(c *C) {
+	obj := &typeWithSetterError{}
+	err := bson.Unmarshal([]byte(sampleItems[0].data), obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.received, Equals, bson.D{{"hello", "world"}})
+}
+
+type typeWithRawSetter struct {
+	raw bson.Raw
+}
+
+func (o *typeWithRawSetter) SetBSON(raw bson.Raw) os.Error {
+	if raw.Kind == bson.KindBool {
+		return os.NewError("Bool not supported")
+	}
+	o.raw = raw
+	return nil
+}
+
+type docWithRawSetterField struct {
+	Field *typeWithRawSetter "_"
+}
+
+func (s *S) TestUnmarshalAllItemsWithRawSetter(c *C) {
+	for i, item := range allItems {
+		if item.data == "" || item.data[0] == bson.KindBool {
+			continue
+		}
+		obj := &docWithRawSetterField{}
+		err := bson.Unmarshal([]byte(wrapInDoc(item.data)), obj)
+		c.Assert(err, IsNil)
+		c.Assert(obj.Field, NotNil)
+		c.Assert(obj.Field.raw, Equals, bson.Raw{item.data[0], []byte(item.data[3:])},
+			Bug("Failed on item %d", i))
+	}
+}
+
+func (s *S) TestUnmarshalWithRawSetterError(c *C) {
+	obj := &docWithRawSetterField{}
+	err := bson.Unmarshal([]byte(wrapInDoc("\x08_\x00\x01")), obj)
+	c.Assert(err, Matches, "Bool not supported")
+}
+
+func (s *S) TestUnmarshalWholeDocumentWithRawSetter(c *C) {
+	obj := &typeWithRawSetter{}
+	err := bson.Unmarshal([]byte(sampleItems[0].data), obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.raw, Equals, bson.Raw{bson.KindDocument, []byte(sampleItems[0].data)})
+}
+
+func (s *S) TestRawD(c *C) {
+	data, err := bson.Marshal(bson.D{{"b", 1}, {"a", bson.M{"c": "x"}}, {"b", true}})
+	c.Assert(err, IsNil)
+
+	var rawd bson.RawD
+	c.Assert(bson.Unmarshal(data, &rawd), IsNil)
+	c.Assert(rawd, Equals, bson.RawD{
+		{"b", bson.Raw{bson.KindInt32, []byte("\x01\x00\x00\x00")}},
+		{"a", bson.Raw{bson.KindDocument, []byte(wrapInDoc("\x02c\x00\x02\x00\x00\x00x\x00"))}},
+		{"b", bson.Raw{bson.KindBool, []byte("\x01")}},
+	})
+	c.Assert(rawd.Map(), Equals, map[string]bson.Raw{
+		"a": rawd[1].Value,
+		"b": rawd[2].Value,
+	})
+
+	out, err := bson.Marshal(rawd)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, string(data))
+
+	// Elements may be reordered and filtered cheaply.
+	out, err = bson.Marshal(bson.M{"doc": bson.RawD{rawd[1], rawd[0]}})
+	c.Assert(err, IsNil)
+	var doc struct{ Doc bson.RawD }
+	c.Assert(bson.Unmarshal(out, &doc), IsNil)
+	c.Assert(doc.Doc, Equals, bson.RawD{rawd[1], rawd[0]})
+}
+
+func (s *S) TestDMap(c *C) {
+	d := bson.D{{"a", 1}, {"b", 2}}
+	c.Assert(d.Map(), Equals, bson.M{"a": 1, "b": 2})
+}
+
+func (s *S) TestUnmarshalD(c *C) {
+	data, err := bson.Marshal(bson.D{{"b", 1}, {"a", bson.M{"c": "x"}}, {"c", true}})
+	c.Assert(err, IsNil)
+	d := bson.D{{"old", 1}}
+	err = bson.Unmarshal(data, &d)
+	c.Assert(err, IsNil)
+	c.Assert(d, Equals, bson.D{{"b", 1}, {"a", bson.M{"c": "x"}}, {"c", true}})
+
+	var pd *bson.D
+	err = bson.Unmarshal(data, &pd)
+	c.Assert(err, IsNil)
+	c.Assert(*pd, Equals, d)
+}
+
+func (s *S) TestUnmarshalUnsupportedSlice(c *C) {
+	var l []int
+	err := bson.Unmarshal([]byte(wrapInDoc("")), &l)
+	c.Assert(err, Matches, `Unsupported document type for unmarshaling: \[\]int`)
+}
+
+func (s *S) TestNewD(c *C) {
+	d := bson.NewD("a", 1, "b", true)
+	c.Assert(d, Equals, bson.D{{"a", 1}, {"b", true}})
+	c.Assert(bson.NewD(), Equals, bson.D{})
+}
+
+func (s *S) TestNewDBadPairs(c *C) {
+	defer func() {
+		c.Assert(recover(), Equals, "NewD needs name/value pairs, got an odd number of arguments")
+	}()
+	bson.NewD("a", 1, "b")
+}
+
+func (s *S) TestNewDBadName(c *C) {
+	defer func() {
+		c.Assert(recover(), Equals, "NewD needs string names, got 1 at position 2")
+	}()
+	bson.NewD("a", 1, 1, 2)
+}
+
+func (s *S) TestDAppend(c *C) {
+	d := bson.D{{"a", 1}}.Append("b", true).Append("c", "x")
+	c.Assert(d, Equals, bson.D{{"a", 1}, {"b", true}, {"c", "x"}})
+
+	data, err := bson.Marshal(bson.D{}.Append("b", 1).Append("a", 2))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x10b\x00\x01\x00\x00\x00\x10a\x00\x02\x00\x00\x00"))
+}
+
+
+// --------------------------------------------------------------------------
+// Codec test cases.
+
+type codecTemp struct{ deg float64 }
+
+type codecDoc struct {
+	T codecTemp
+	P *codecTemp
+	N *codecTemp
+}
+
+func encodeTemp(v reflect.Value) (kind byte, data []byte) {
+	data = make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, math.Float64bits(v.Interface().(codecTemp).deg))
+	return bson.KindDouble, data
+}
+
+func decodeTemp(kind byte, data []byte, v reflect.Value) bool {
+	if kind != bson.KindDouble {
+		return false
 	}
+	v.Set(reflect.ValueOf(codecTemp{math.Float64frombits(binary.LittleEndian.Uint64(data))}))
+	return true
 }
 
-func (s *S) TestUnmarshalWholeDocumentWithSetter(c *C) {
-	obj := &typeWithSetter{}
-	err := bson.Unmarshal([]byte(sampleItems[0].data), obj)
+func (s *S) TestRegisterCodec(c *C) {
+	t := reflect.TypeOf(codecTemp{})
+	bson.RegisterCodec(t, encodeTemp, decodeTemp)
+	defer bson.RegisterCodec(t, nil, nil)
+
+	data, err := bson.Marshal(&codecDoc{codecTemp{21.5}, &codecTemp{-3}, nil})
 	c.Assert(err, IsNil)
-	c.Assert(obj.received, Equals, bson.D{{"hello", "world"}})
-}
+	m := bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m, Equals, bson.M{"t": 21.5, "p": -3.0, "n": nil})
 
-func (s *S) TestUnmarshalWithFalseSetterIgnoresValue(c *C) {
-	setterResult["2"] = false
-	setterResult["4"] = false
-	defer func() {
-		setterResult["2"] = false, false
-		setterResult["4"] = false, false
-	}()
+	var doc codecDoc
+	c.Assert(bson.Unmarshal(data, &doc), IsNil)
+	c.Assert(doc.T, Equals, codecTemp{21.5})
+	c.Assert(*doc.P, Equals, codecTemp{-3})
+	c.Assert(doc.N, IsNil)
 
-	m := map[string]*typeWithSetter{}
-	data := wrapInDoc("\x02abc\x00\x02\x00\x00\x001\x00" +
-		"\x02def\x00\x02\x00\x00\x002\x00" +
-		"\x02ghi\x00\x02\x00\x00\x003\x00" +
-		"\x02jkl\x00\x02\x00\x00\x004\x00")
-	err := bson.Unmarshal([]byte(data), m)
+	// Elements rejected by the codec are skipped.
+	data, err = bson.Marshal(bson.M{"t": "hot", "p": "cold"})
 	c.Assert(err, IsNil)
-	c.Assert(m["abc"], NotNil)
-	c.Assert(m["def"], IsNil)
-	c.Assert(m["ghi"], NotNil)
-	c.Assert(m["jkl"], IsNil)
+	doc = codecDoc{}
+	c.Assert(bson.Unmarshal(data, &doc), IsNil)
+	c.Assert(doc.T, Equals, codecTemp{})
+	c.Assert(doc.P, IsNil)
+
+	// Once removed, values are processed as usual.
+	bson.RegisterCodec(t, nil, nil)
+	data, err = bson.Marshal(&codecDoc{T: codecTemp{21.5}})
+	c.Assert(err, IsNil)
+	m = bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m["t"], Equals, bson.M{})
+}
 
-	c.Assert(m["abc"].received, Equals, "1")
-	c.Assert(m["ghi"].received, Equals, "3")
+type bigDoc struct {
+	I *big.Int
+	V big.Int
+	R *big.Rat
 }
 
-func (s *S) TestDMap(c *C) {
-	d := bson.D{{"a", 1}, {"b", 2}}
-	c.Assert(d.Map(), Equals, bson.M{"a": 1, "b": 2})
+func (s *S) TestMarshalBig(c *C) {
+	huge, _ := new(big.Int).SetString("-12345678901234567890123456789012345", 10)
+	doc := &bigDoc{big.NewInt(-123), *huge, big.NewRat(-1, 3)}
+	data, err := bson.Marshal(doc)
+	c.Assert(err, IsNil)
+
+	m := bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m["i"], Equals, parseDecimal128("-123"))
+	c.Assert(m["v"].(*big.Int).String(), Equals, huge.String())
+	c.Assert(m["r"], Equals, "-1/3")
+
+	var out bigDoc
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.I.String(), Equals, "-123")
+	c.Assert(out.V.String(), Equals, huge.String())
+	c.Assert(out.R.String(), Equals, "-1/3")
 }
 
+func (s *S) TestMarshalBigIntThroughInterface(c *C) {
+	huge, _ := new(big.Int).SetString("1234567890123456789012345678901234567890", 10)
+	data, err := bson.Marshal(bson.M{"v": huge})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x03v\x00"+
+		wrapInDoc("\x02$bigInt\x00\x29\x00\x00\x00"+huge.String()+"\x00")))
+
+	var doc interface{}
+	c.Assert(bson.Unmarshal(data, &doc), IsNil)
+	v, ok := doc.(bson.M)["v"].(*big.Int)
+	c.Assert(ok, Equals, true)
+	c.Assert(v.String(), Equals, huge.String())
+
+	again, err := bson.Marshal(doc)
+	c.Assert(err, IsNil)
+	c.Assert(string(again), Equals, string(data))
+
+	var out bigDoc
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.V.String(), Equals, huge.String())
+
+	// Documents with other elements are left alone.
+	data, err = bson.Marshal(bson.M{"v": bson.D{{"$bigInt", "1"}, {"x", 1}}})
+	c.Assert(err, IsNil)
+	m := bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m["v"], Equals, bson.M{"$bigInt": "1", "x": 1})
+}
+
+var unmarshalBigItems = []struct {
+	value    interface{}
+	int, rat string
+}{
+	{42, "42", "42/1"},
+	{int64(1 << 40), "1099511627776", "1099511627776/1"},
+	{1e20, "100000000000000000000", "100000000000000000000/1"},
+	{0.25, "", "1/4"},
+	{parseDecimal128("1.50E+3"), "1500", "1500/1"},
+	{parseDecimal128("-0.125"), "", "-1/8"},
+	{"123456789012345678901234567890123456789", "123456789012345678901234567890123456789",
+		"123456789012345678901234567890123456789/1"},
+	{"2/4", "", "1/2"},
+	{"1.5", "", "3/2"},
+	{math.NaN(), "", ""},
+	{parseDecimal128("Infinity"), "", ""},
+	{"1/0", "", ""},
+	{"abc", "", ""},
+	{true, "", ""},
+}
+
+func (s *S) TestUnmarshalBig(c *C) {
+	for i, item := range unmarshalBigItems {
+		data, err := bson.Marshal(bson.M{"i": item.value, "r": item.value})
+		c.Assert(err, IsNil)
+		var out bigDoc
+		c.Assert(bson.Unmarshal(data, &out), IsNil)
+		if item.int == "" {
+			c.Assert(out.I, IsNil, Bug("Failed on item %d", i))
+		} else {
+			c.Assert(out.I.String(), Equals, item.int, Bug("Failed on item %d", i))
+		}
+		if item.rat == "" {
+			c.Assert(out.R, IsNil, Bug("Failed on item %d", i))
+		} else {
+			c.Assert(out.R.String(), Equals, item.rat, Bug("Failed on item %d", i))
+		}
+	}
+}
 
 // --------------------------------------------------------------------------
 // Getter test cases.
@@ -750,6 +2438,137 @@ type typeWithIntGetter struct {
 	V intGetter "/s"
 }
 
+type stringerKey struct{ A, B int }
+
+func (k stringerKey) String() string {
+	return strconv.Itoa(k.A) + "-" + strconv.Itoa(k.B)
+}
+
+func (s *S) TestMarshalNonStringMapKeys(c *C) {
+	data, err := bson.MarshalSorted(map[int]string{10: "a", -2: "b"})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x02-2\x00\x02\x00\x00\x00b\x00\x0210\x00\x02\x00\x00\x00a\x00"))
+
+	m := map[int]string{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m, Equals, map[int]string{10: "a", -2: "b"})
+
+	data, err = bson.Marshal(map[uint16]bool{7: true})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x087\x00\x01"))
+	u := map[uint16]bool{}
+	c.Assert(bson.Unmarshal(data, u), IsNil)
+	c.Assert(u, Equals, map[uint16]bool{7: true})
+
+	data, err = bson.Marshal(map[stringerKey]int{stringerKey{1, 2}: 3})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x101-2\x00\x03\x00\x00\x00"))
+
+	_, err = bson.Marshal(map[float64]int{1.5: 1})
+	c.Assert(err, Matches, "Can't marshal map key of type float64")
+}
+
+type colorKey int
+
+func (k colorKey) String() string {
+	return [...]string{"red", "green"}[k]
+}
+
+type levelKey int
+
+func (k levelKey) String() string {
+	return [...]string{"low", "high"}[k]
+}
+
+func (k *levelKey) UnmarshalText(text []byte) os.Error {
+	switch string(text) {
+	case "low":
+		*k = 0
+	case "high":
+		*k = 1
+	default:
+		return os.NewError("Bad level")
+	}
+	return nil
+}
+
+type textKey struct{ A, B int }
+
+func (k textKey) MarshalText() ([]byte, os.Error) {
+	if k.A < 0 {
+		return nil, os.NewError("Negative key")
+	}
+	return []byte(strconv.Itoa(k.A) + ":" + strconv.Itoa(k.B)), nil
+}
+
+func (k *textKey) UnmarshalText(text []byte) os.Error {
+	parts := strings.Split(string(text), ":")
+	if len(parts) != 2 {
+		return os.NewError("Bad key")
+	}
+	var err os.Error
+	if k.A, err = strconv.Atoi(parts[0]); err != nil {
+		return err
+	}
+	k.B, err = strconv.Atoi(parts[1])
+	return err
+}
+
+func (s *S) TestMarshalTextAndStringerMapKeys(c *C) {
+	data, err := bson.MarshalSorted(map[colorKey]int{0: 1, 1: 2})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x100\x00\x01\x00\x00\x00\x101\x00\x02\x00\x00\x00"))
+	cm := map[colorKey]int{}
+	c.Assert(bson.Unmarshal(data, cm), IsNil)
+	c.Assert(cm, Equals, map[colorKey]int{0: 1, 1: 2})
+
+	data, err = bson.MarshalSorted(map[levelKey]int{0: 1, 1: 2})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x10high\x00\x02\x00\x00\x00\x10low\x00\x01\x00\x00\x00"))
+	lm := map[levelKey]int{}
+	c.Assert(bson.Unmarshal(data, lm), IsNil)
+	c.Assert(lm, Equals, map[levelKey]int{0: 1, 1: 2})
+
+	data, err = bson.Marshal(map[textKey]string{textKey{1, 2}: "a"})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x021:2\x00\x02\x00\x00\x00a\x00"))
+	m := map[textKey]string{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m, Equals, map[textKey]string{textKey{1, 2}: "a"})
+
+	err = bson.Unmarshal([]byte(wrapInDoc("\x02x\x00\x02\x00\x00\x00a\x00")), m)
+	c.Assert(err, Matches, `Can't unmarshal document key "x" into map key of type bson_test.textKey: Bad key`)
+
+	_, err = bson.Marshal(map[textKey]string{textKey{-1, 0}: "a"})
+	c.Assert(err, Matches, "Negative key")
+}
+
+func (s *S) TestMarshalNestedPointers(c *C) {
+	n := 42
+	pn := &n
+	var iface interface{} = &pn
+	var nilPtr *int
+	var nilIface interface{}
+	var nilGetter *typeWithGetter
+	items := []struct {
+		value interface{}
+		data  string
+	}{
+		{&pn, "\x10_\x00\x2a\x00\x00\x00"},
+		{&iface, "\x10_\x00\x2a\x00\x00\x00"},
+		{&nilPtr, "\x0A_\x00"},
+		{(**int)(nil), "\x0A_\x00"},
+		{&nilIface, "\x0A_\x00"},
+		{nilGetter, "\x0A_\x00"},
+		{&typeWithGetter{&pn}, "\x10_\x00\x2a\x00\x00\x00"},
+	}
+	for i, item := range items {
+		data, err := bson.Marshal(bson.M{"_": item.value})
+		c.Assert(err, IsNil, Bug("Failed on item %d", i))
+		c.Assert(string(data), Equals, wrapInDoc(item.data), Bug("Failed on item %d", i))
+	}
+}
+
 func (s *S) TestMarshalShortWithGetter(c *C) {
 	obj := typeWithIntGetter{42}
 	data, err := bson.Marshal(obj)
@@ -759,6 +2578,230 @@ func (s *S) TestMarshalShortWithGetter(c *C) {
 	c.Assert(m["v"], Equals, 42)
 }
 
+type typeWithGetterError struct {
+	result interface{}
+	err    os.Error
+}
+
+func (t *typeWithGetterError) GetBSON() (interface{}, os.Error) {
+	return t.result, t.err
+}
+
+type docWithGetterErrorField struct {
+	Field *typeWithGetterError "_"
+}
+
+func (s *S) TestMarshalWithGetterError(c *C) {
+	obj := &docWithGetterErrorField{&typeWithGetterError{"ok", nil}}
+	data, err := bson.Marshal(obj)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x02_\x00\x03\x00\x00\x00ok\x00"))
+
+	obj.Field.err = os.NewError("Bad state")
+	_, err = bson.Marshal(obj)
+	c.Assert(err, Matches, `field "_": Bad state`)
+
+	_, err = bson.Marshal(obj.Field)
+	c.Assert(err, Matches, "Bad state")
+}
+
+func (s *S) TestEncoderAfterGetterError(c *C) {
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	obj := &docWithGetterErrorField{&typeWithGetterError{"ok", os.NewError("Bad state")}}
+	_, err := enc.Marshal(obj)
+	c.Assert(err, Matches, `field "_": Bad state`)
+
+	// Pointers visited by the failed call aren't taken as cycles.
+	obj.Field.err = nil
+	enc.Reset()
+	data, err := enc.Marshal(obj)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x02_\x00\x03\x00\x00\x00ok\x00"))
+	data, err = enc.Marshal(obj)
+	c.Assert(err, IsNil)
+}
+
+type typeWithMarshaler struct {
+	data []byte
+	err  os.Error
+}
+
+func (t *typeWithMarshaler) MarshalBSON() ([]byte, os.Error) {
+	return t.data, t.err
+}
+
+func (t *typeWithMarshaler) GetBSON() interface{} {
+	return "getter"
+}
+
+func (t *typeWithMarshaler) UnmarshalBSON(data []byte) os.Error {
+	if len(data) == 5 {
+		return os.NewError("Empty document")
+	}
+	t.data = append([]byte{}, data...)
+	return nil
+}
+
+func (t *typeWithMarshaler) SetBSON(raw bson.Raw) os.Error {
+	return os.NewError("SetBSON called")
+}
+
+type docWithMarshalerField struct {
+	Field *typeWithMarshaler "_"
+}
+
+func (s *S) TestMarshalWithMarshaler(c *C) {
+	inner := wrapInDoc("\x08a\x00\x01")
+	obj := &docWithMarshalerField{&typeWithMarshaler{data: []byte(inner)}}
+	data, err := bson.Marshal(obj)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x03_\x00"+inner))
+
+	data, err = bson.Marshal(obj.Field)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, inner)
+
+	obj.Field.err = os.NewError("Bad state")
+	_, err = bson.Marshal(obj)
+	c.Assert(err, Matches, `field "_": Bad state`)
+
+	obj.Field.err = nil
+	obj.Field.data = []byte(inner[:len(inner)-1])
+	_, err = bson.Marshal(obj)
+	c.Assert(err, Matches, `field "_": MarshalBSON returned an invalid document`)
+}
+
+func (s *S) TestUnmarshalWithUnmarshaler(c *C) {
+	inner := wrapInDoc("\x08a\x00\x01")
+	obj := &docWithMarshalerField{}
+	err := bson.Unmarshal([]byte(wrapInDoc("\x03_\x00"+inner)), obj)
+	c.Assert(err, IsNil)
+	c.Assert(obj.Field, NotNil)
+	c.Assert(string(obj.Field.data), Equals, inner)
+
+	err = bson.Unmarshal([]byte(wrapInDoc("\x03_\x00"+wrapInDoc(""))), obj)
+	c.Assert(err, Matches, "Empty document")
+
+	// Other kinds are handed to the remaining interfaces.
+	err = bson.Unmarshal([]byte(wrapInDoc("\x08_\x00\x01")), obj)
+	c.Assert(err, Matches, "SetBSON called")
+
+	whole := &typeWithMarshaler{}
+	err = bson.Unmarshal([]byte(inner), whole)
+	c.Assert(err, IsNil)
+	c.Assert(string(whole.data), Equals, inner)
+}
+
+type cyclicNode struct {
+	Name string
+	Next *cyclicNode ",omitempty"
+	Kids []*cyclicNode ",omitempty"
+}
+
+func (s *S) TestMarshalCyclicData(c *C) {
+	a := &cyclicNode{Name: "a"}
+	b := &cyclicNode{Name: "b", Next: a}
+	a.Next = b
+	_, err := bson.Marshal(a)
+	c.Assert(err, Matches, `field "next.next": Can't marshal cyclic data structure: \*bson_test.cyclicNode refers to itself`)
+
+	m := bson.M{}
+	m["m"] = m
+	_, err = bson.Marshal(m)
+	c.Assert(err, Matches, `field "m": Can't marshal cyclic data structure: bson.M refers to itself`)
+
+	enc := bson.NewEncoder()
+	defer enc.Release()
+	_, err = enc.Marshal(a)
+	c.Assert(err, NotNil)
+
+	// The same values may be shared by several elements.
+	leaf := &cyclicNode{Name: "leaf"}
+	root := &cyclicNode{Name: "root", Next: leaf, Kids: []*cyclicNode{leaf, leaf}}
+	data, err := enc.Marshal(root)
+	c.Assert(err, IsNil)
+	var out cyclicNode
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.Kids, Equals, []*cyclicNode{leaf, leaf})
+
+	shared := bson.M{"a": 1}
+	_, err = bson.Marshal(bson.D{{"x", shared}, {"y", shared}})
+	c.Assert(err, IsNil)
+}
+
+// --------------------------------------------------------------------------
+// Default key function tests.
+
+type keyFuncDoc struct {
+	FirstName string
+	LastName  string "last"
+}
+
+func lowerFirst(name string) string {
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+func (s *S) TestSetDefaultKeyFunc(c *C) {
+	data, err := bson.Marshal(&keyFuncDoc{"Joe", "Doe"})
+	c.Assert(err, IsNil)
+	m := bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m, Equals, bson.M{"firstname": "Joe", "last": "Doe"})
+
+	bson.SetDefaultKeyFunc(lowerFirst)
+	defer bson.SetDefaultKeyFunc(nil)
+
+	data, err = bson.Marshal(&keyFuncDoc{"Joe", "Doe"})
+	c.Assert(err, IsNil)
+	m = bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m, Equals, bson.M{"firstName": "Joe", "last": "Doe"})
+
+	doc := &keyFuncDoc{}
+	c.Assert(bson.Unmarshal(data, doc), IsNil)
+	c.Assert(doc, Equals, &keyFuncDoc{"Joe", "Doe"})
+
+	bson.SetDefaultKeyFunc(nil)
+	data, err = bson.Marshal(&keyFuncDoc{"Joe", "Doe"})
+	c.Assert(err, IsNil)
+	m = bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m, Equals, bson.M{"firstname": "Joe", "last": "Doe"})
+}
+
+type taggedPrivateDoc struct {
+	Name  string
+	age   int "age"
+	notes string "-"
+}
+
+type inlineTaggedPrivateDoc struct {
+	Inner taggedPrivateDoc ",inline"
+}
+
+func (s *S) TestSetCheckUnexportedTags(c *C) {
+	doc := &taggedPrivateDoc{Name: "Joe", age: 42}
+	data, err := bson.Marshal(doc)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x02name\x00\x04\x00\x00\x00Joe\x00"))
+
+	bson.SetCheckUnexportedTags(true)
+	defer bson.SetCheckUnexportedTags(false)
+
+	msg := "Unexported field 'age' in struct bson_test.taggedPrivateDoc has a tag"
+	_, err = bson.Marshal(doc)
+	c.Assert(err, Matches, msg)
+	err = bson.Unmarshal(data, doc)
+	c.Assert(err, Matches, msg)
+
+	_, err = bson.Marshal(&inlineTaggedPrivateDoc{})
+	c.Assert(err, Matches, msg)
+
+	_, err = bson.Marshal(&keyFuncDoc{"Joe", "Doe"})
+	c.Assert(err, IsNil)
+}
+
 // --------------------------------------------------------------------------
 // Cross-type conversion tests.
 
@@ -767,6 +2810,25 @@ type crossTypeItem struct {
 	obj2 interface{}
 }
 
+type inlineBase struct {
+	A int
+	B string "bee"
+}
+type inlineStruct struct {
+	Base inlineBase ",inline"
+	C    int
+}
+type inlineNested struct {
+	Inner inlineStruct ",inline"
+	D     bool
+}
+
+type inlineMiddle struct {
+	Z     int
+	Inner inlineStruct ",inline"
+	Y     int
+}
+
 type condStr struct {
 	V string "/c"
 }
@@ -791,9 +2853,21 @@ type condSlice struct {
 type condMap struct {
 	V map[string]int "/c"
 }
+type condObjectId struct {
+	V bson.ObjectId "/c"
+}
+type condTime struct {
+	V time.Time ",omitempty"
+}
 type namedCondStr struct {
 	V string "myv/c"
 }
+type omitEmptyStr struct {
+	V string "myv,omitempty"
+}
+type omitEmptyInt struct {
+	V int "myv,omitempty"
+}
 
 type shortInt struct {
 	V int64 "/s"
@@ -801,6 +2875,15 @@ type shortInt struct {
 type shortUint struct {
 	V uint64 "/s"
 }
+type omitEmptyDefaultKey struct {
+	V string ",omitempty"
+}
+type minSizeInt struct {
+	V int64 ",minsize"
+}
+type minSizeCondInt struct {
+	V int64 "myv,minsize,omitempty"
+}
 type shortIface struct {
 	V interface{} "/s"
 }
@@ -812,6 +2895,8 @@ type slashedName struct {
 	V string "a/b/"
 }
 
+var hashvar = Hash("hash")
+
 var truevar = true
 var falsevar = false
 
@@ -832,6 +2917,7 @@ var twoWayCrossItems = []crossTypeItem{
 	{&struct{ I int8 }{42}, &struct{ I int32 }{42}},
 	{&struct{ I int8 }{42}, &struct{ I int64 }{42}},
 	{&struct{ I int32 }{42}, &struct{ I int64 }{42}},
+	{&struct{ I int }{42}, &struct{ I bson.Int64 }{42}},
 
 	// uint<=>uint
 	{&struct{ I uint }{42}, &struct{ I uint8 }{42}},
@@ -920,6 +3006,10 @@ var twoWayCrossItems = []crossTypeItem{
 	{&struct{ S []int }{[]int{1, 2, 3}}, map[string][]int{"s": []int{1, 2, 3}}},
 	{&struct{ S *[]int }{&[]int{1, 2, 3}}, map[string][]int{"s": []int{1, 2, 3}}},
 
+	// Named byte slices
+	{&struct{ H Hash }{Hash("yo")}, map[string][]byte{"h": []byte("yo")}},
+	{&struct{ H *Hash }{&hashvar}, map[string]Hash{"h": hashvar}},
+
 	// Conditionals
 	{&condBool{true}, map[string]bool{"v": true}},
 	{&condBool{}, map[string]bool{}},
@@ -943,6 +3033,12 @@ var twoWayCrossItems = []crossTypeItem{
 
 	{&namedCondStr{"yo"}, map[string]string{"myv": "yo"}},
 	{&namedCondStr{}, map[string]string{}},
+	{&omitEmptyStr{"yo"}, map[string]string{"myv": "yo"}},
+	{&omitEmptyStr{}, map[string]string{}},
+	{&omitEmptyInt{1}, map[string]int{"myv": 1}},
+	{&omitEmptyInt{}, map[string]int{}},
+	{&omitEmptyDefaultKey{"yo"}, map[string]string{"v": "yo"}},
+	{&omitEmptyDefaultKey{}, map[string]string{}},
 
 	{&shortInt{1}, map[string]interface{}{"v": 1}},
 	{&shortInt{1 << 30}, map[string]interface{}{"v": 1 << 30}},
@@ -950,9 +3046,17 @@ var twoWayCrossItems = []crossTypeItem{
 	{&shortUint{1 << 30}, map[string]interface{}{"v": 1 << 30}},
 	{&shortUint{1 << 31}, map[string]interface{}{"v": int64(1 << 31)}},
 	{&shortIface{int64(1) << 31}, map[string]interface{}{"v": int64(1 << 31)}},
+	{&minSizeInt{1}, map[string]interface{}{"v": 1}},
+	{&minSizeInt{1 << 31}, map[string]interface{}{"v": int64(1 << 31)}},
+	{&minSizeCondInt{1}, map[string]interface{}{"myv": 1}},
+	{&minSizeCondInt{}, map[string]interface{}{}},
 	{&shortPtr{int64ptr}, map[string]interface{}{"v": intvar}},
 
 	{&slashedName{"yo"}, map[string]string{"a/b": "yo"}},
+
+	// Inlined structs
+	{&inlineStruct{inlineBase{1, "b"}, 2}, bson.M{"a": 1, "bee": "b", "c": 2}},
+	{&inlineNested{inlineStruct{inlineBase{1, "b"}, 2}, true}, bson.M{"a": 1, "bee": "b", "c": 2, "d": true}},
 }
 
 // Same thing, but only one way (obj1 => obj2).
@@ -961,35 +3065,174 @@ var oneWayCrossItems = []crossTypeItem{
 	{map[string]interface{}{"a": 1, "b": "2", "c": 3},
 		map[string]int{"a": 1, "c": 3}},
 
-	// Can't decode int into struct.
-	{bson.M{"a": bson.M{"b": 2}}, &struct{ A bool }{}},
+	// Can't decode int into struct.
+	{bson.M{"a": bson.M{"b": 2}}, &struct{ A bool }{}},
+
+	// Would get decoded into a int32 too in the opposite direction.
+	{&shortIface{int64(1) << 30}, map[string]interface{}{"v": 1 << 30}},
+
+	// Strings may be unmarshaled into named byte slices.
+	{bson.M{"h": "yo"}, &struct{ H Hash }{Hash("yo")}},
+}
+
+func testCrossPair(c *C, dump interface{}, load interface{}, bug interface{}) {
+	//c.Logf("")
+	zero := makeZeroDoc(load)
+	data, err := bson.Marshal(dump)
+	c.Assert(err, IsNil, bug)
+	c.Logf("Data: %#v", string(data))
+	err = bson.Unmarshal(data, zero)
+	c.Assert(err, IsNil, bug)
+	c.Assert(zero, Equals, load, bug)
+}
+
+func (s *S) TestTwoWayCrossPairs(c *C) {
+	for i, item := range twoWayCrossItems {
+		testCrossPair(c, item.obj1, item.obj2, Bug("#%d obj1 => obj2", i))
+		testCrossPair(c, item.obj2, item.obj1, Bug("#%d obj1 <= obj2", i))
+	}
+}
+
+func (s *S) TestOneWayCrossPairs(c *C) {
+	for i, item := range oneWayCrossItems {
+		testCrossPair(c, item.obj1, item.obj2, Bug("#%d obj1 => obj2", i))
+	}
+}
+
+// --------------------------------------------------------------------------
+// time.Time marshaling tests.
+
+type timeDoc struct {
+	T time.Time
+}
+
+func (s *S) TestMarshalTime(c *C) {
+	data, err := bson.Marshal(&timeDoc{time.Unix(0, 258e6)})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x09t\x00\x02\x01\x00\x00\x00\x00\x00\x00"))
+}
+
+func (s *S) TestUnmarshalTime(c *C) {
+	doc := &timeDoc{}
+	err := bson.Unmarshal([]byte(wrapInDoc("\x09t\x00\x02\x01\x00\x00\x00\x00\x00\x00")), doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.T.Equal(time.Unix(0, 258e6)), Equals, true, Bug("Got %v", doc.T))
+	c.Assert(doc.T.Location(), Equals, time.UTC)
+}
+
+func (s *S) TestTimeRoundtrip(c *C) {
+	times := []time.Time{
+		time.Date(2011, 5, 24, 10, 20, 30, 123456789, time.UTC),
+		time.Date(1969, 7, 20, 20, 17, 40, 500e6, time.UTC),
+		time.Date(1500, 1, 2, 3, 4, 5, 6e6, time.UTC),
+		time.Date(2500, 12, 31, 23, 59, 59, 999e6, time.UTC),
+		time.Date(1, 1, 1, 0, 0, 0, 1e6, time.UTC),
+	}
+	for _, t := range times {
+		data, err := bson.Marshal(&timeDoc{t})
+		c.Assert(err, IsNil)
+		doc := &timeDoc{}
+		err = bson.Unmarshal(data, doc)
+		c.Assert(err, IsNil)
+		// Precision is truncated to milliseconds, as with bson.Timestamp.
+		expected := t.Add(-time.Duration(t.Nanosecond() % 1e6))
+		c.Assert(doc.T.Equal(expected), Equals, true, Bug("Got %v, expected %v", doc.T, expected))
+	}
+}
+
+func (s *S) TestMarshalTimeInLocation(c *C) {
+	loc := time.FixedZone("UTC+1", 3600)
+	data, err := bson.Marshal(&timeDoc{time.Unix(0, 258e6).In(loc)})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x09t\x00\x02\x01\x00\x00\x00\x00\x00\x00"))
+}
+
+func (s *S) TestDecoderTimeLocation(c *C) {
+	loc := time.FixedZone("UTC+1", 3600)
+	dec := &bson.Decoder{Location: loc}
+	doc := &timeDoc{}
+	err := dec.Unmarshal([]byte(wrapInDoc("\x09t\x00\x02\x01\x00\x00\x00\x00\x00\x00")), doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.T.Equal(time.Unix(0, 258e6)), Equals, true, Bug("Got %v", doc.T))
+	c.Assert(doc.T.Location(), Equals, loc)
+
+	// The zero time is preserved as such.
+	data, err := bson.Marshal(&timeDoc{})
+	c.Assert(err, IsNil)
+	err = dec.Unmarshal(data, doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc, Equals, &timeDoc{})
+}
+
+func (s *S) TestZeroTimeRoundtrip(c *C) {
+	data, err := bson.Marshal(&timeDoc{})
+	c.Assert(err, IsNil)
+	doc := &timeDoc{time.Now()}
+	err = bson.Unmarshal(data, doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.T.IsZero(), Equals, true)
+	c.Assert(doc, Equals, &timeDoc{})
+}
+
+func (s *S) TestFarTimesIntoPointersAndLocations(c *C) {
+	t := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	data, err := bson.Marshal(bson.M{"t": t, "z": time.Time{}})
+	c.Assert(err, IsNil)
+
+	var out struct{ T, Z *time.Time }
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.T.Equal(t), Equals, true, Bug("Got %v", out.T))
+	c.Assert(out.Z.IsZero(), Equals, true, Bug("Got %v", out.Z))
+
+	loc := time.FixedZone("UTC+1", 3600)
+	var doc struct{ T, Z time.Time }
+	c.Assert((&bson.Decoder{Location: loc}).Unmarshal(data, &doc), IsNil)
+	c.Assert(doc.T.Equal(t), Equals, true, Bug("Got %v", doc.T))
+	c.Assert(doc.T.Location(), Equals, loc)
+	c.Assert(doc.Z.IsZero(), Equals, true, Bug("Got %v", doc.Z))
 
-	// Would get decoded into a int32 too in the opposite direction.
-	{&shortIface{int64(1) << 30}, map[string]interface{}{"v": 1 << 30}},
+	// Numeric times far from the epoch are handled as well.
+	data, err = bson.Marshal(bson.M{"t": int64(-62135596800000 + 1)})
+	c.Assert(err, IsNil)
+	c.Assert((&bson.Decoder{NumericTimes: true}).Unmarshal(data, &doc), IsNil)
+	c.Assert(doc.T.Equal(time.Date(1, 1, 1, 0, 0, 0, 1e6, time.UTC)), Equals, true, Bug("Got %v", doc.T))
 }
 
-func testCrossPair(c *C, dump interface{}, load interface{}, bug interface{}) {
-	//c.Logf("")
-	zero := makeZeroDoc(load)
-	data, err := bson.Marshal(dump)
-	c.Assert(err, IsNil, bug)
-	c.Logf("Data: %#v", string(data))
-	err = bson.Unmarshal(data, zero)
-	c.Assert(err, IsNil, bug)
-	c.Assert(zero, Equals, load, bug)
-}
+func (s *S) TestDecoderNumericTimes(c *C) {
+	data, err := bson.Marshal(bson.M{"a": int64(1258387200123), "b": int32(1000), "c": 1.5})
+	c.Assert(err, IsNil)
 
-func (s *S) TestTwoWayCrossPairs(c *C) {
-	for i, item := range twoWayCrossItems {
-		testCrossPair(c, item.obj1, item.obj2, Bug("#%d obj1 => obj2", i))
-		testCrossPair(c, item.obj2, item.obj1, Bug("#%d obj1 <= obj2", i))
-	}
+	var out struct{ A, B, C time.Time }
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.A.IsZero(), Equals, true)
+	c.Assert(out.B.IsZero(), Equals, true)
+
+	dec := &bson.Decoder{NumericTimes: true}
+	c.Assert(dec.Unmarshal(data, &out), IsNil)
+	c.Assert(out.A, Equals, time.Unix(1258387200, 123e6).UTC())
+	c.Assert(out.B, Equals, time.Unix(1, 0).UTC())
+	c.Assert(out.C.IsZero(), Equals, true)
 }
 
-func (s *S) TestOneWayCrossPairs(c *C) {
-	for i, item := range oneWayCrossItems {
-		testCrossPair(c, item.obj1, item.obj2, Bug("#%d obj1 => obj2", i))
+func (s *S) TestUnmarshalDateTimeIntoInt64(c *C) {
+	var doc struct {
+		T int64
+		I int
+		S bson.Timestamp
 	}
+	data := wrapInDoc("\x09t\x00\x02\x01\x00\x00\x00\x00\x00\x00" +
+		"\x09i\x00\x02\x01\x00\x00\x00\x00\x00\x00" +
+		"\x09s\x00\x02\x01\x00\x00\x00\x00\x00\x00")
+	err := bson.Unmarshal([]byte(data), &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.T, Equals, int64(258))
+	c.Assert(doc.I, Equals, 258)
+	c.Assert(doc.S, Equals, bson.Timestamp(258e6))
+
+	// Milliseconds which don't fit in a Timestamp are preserved.
+	err = bson.Unmarshal([]byte(wrapInDoc("\x09t\x00\x00\x00\x00\x00\x00\x00\x00\x40")), &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.T, Equals, int64(1<<62))
 }
 
 // --------------------------------------------------------------------------
@@ -1001,6 +3244,97 @@ func (s *S) TestObjectIdHex(c *C) {
 	c.Assert(str, Equals, id.String())
 }
 
+func (s *S) TestParseObjectIdHex(c *C) {
+	id, err := bson.ParseObjectIdHex("4d88e15b60f486e428412dc9")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, bson.ObjectIdHex("4d88e15b60f486e428412dc9"))
+
+	for _, s := range []string{"", "4d88e15b60f486e428412dc", "4d88e15b60f486e428412dc9a0", "zz88e15b60f486e428412dc9"} {
+		id, err = bson.ParseObjectIdHex(s)
+		c.Assert(err, Matches, "Invalid input to ObjectIdHex: .*")
+		c.Assert(id, Equals, bson.ObjectId(""))
+	}
+}
+
+func (s *S) TestObjectIdHexMixedCase(c *C) {
+	id := bson.ObjectIdHex("4D88e15B60F486E428412DC9")
+	c.Assert(id, Equals, bson.ObjectIdHex("4d88e15b60f486e428412dc9"))
+	c.Assert(id.ToString(), Equals, "4d88e15b60f486e428412dc9")
+	c.Assert(id.String(), Equals, `ObjectIdHex("4d88e15b60f486e428412dc9")`)
+}
+
+func (s *S) TestObjectIdHexMethods(c *C) {
+	id := bson.ObjectIdHex("4d88e15b60f486e428412dc9")
+	c.Assert(id.Hex(), Equals, "4d88e15b60f486e428412dc9")
+	c.Assert(id.ToString(), Equals, id.Hex())
+	c.Assert(id.String(), Equals, `ObjectIdHex("4d88e15b60f486e428412dc9")`)
+	c.Assert(fmt.Sprint(id), Equals, id.String())
+	c.Assert(bson.ObjectIdHex(id.Hex()), Equals, id)
+	c.Assert(bson.ObjectId("").Hex(), Equals, "")
+}
+
+func (s *S) TestNormalizeObjectIdHex(c *C) {
+	hex, err := bson.NormalizeObjectIdHex("4D88E15B60F486e428412dc9")
+	c.Assert(err, IsNil)
+	c.Assert(hex, Equals, "4d88e15b60f486e428412dc9")
+
+	hex, err = bson.NormalizeObjectIdHex("4D88")
+	c.Assert(err, Matches, `Invalid input to ObjectIdHex: "4D88"`)
+	c.Assert(hex, Equals, "")
+}
+
+func (s *S) TestIsObjectIdHex(c *C) {
+	c.Assert(bson.IsObjectIdHex("4d88e15b60f486e428412dc9"), Equals, true)
+	c.Assert(bson.IsObjectIdHex("4D88E15B60F486E428412DC9"), Equals, true)
+	c.Assert(bson.IsObjectIdHex(""), Equals, false)
+	c.Assert(bson.IsObjectIdHex("4d88e15b60f486e428412dc"), Equals, false)
+	c.Assert(bson.IsObjectIdHex("4d88e15b60f486e428412dc9a0"), Equals, false)
+	c.Assert(bson.IsObjectIdHex("4d88e15b60f486e428412dcg"), Equals, false)
+}
+
+func (s *S) TestObjectIdHexPanicsOnInvalidInput(c *C) {
+	defer func() {
+		c.Assert(recover(), Equals, `Invalid input to ObjectIdHex: "4d88"`)
+	}()
+	bson.ObjectIdHex("4d88")
+}
+
+// --------------------------------------------------------------------------
+// ObjectId JSON marshaling tests.
+
+func (s *S) TestObjectIdMarshalJSON(c *C) {
+	id := bson.ObjectIdHex("4d88e15b60f486e428412dc9")
+	data, err := id.MarshalJSON()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `"4d88e15b60f486e428412dc9"`)
+}
+
+var jsonIdItems = []struct {
+	json  string
+	id    bson.ObjectId
+	error string
+}{
+	{`"4d88e15b60f486e428412dc9"`, bson.ObjectIdHex("4d88e15b60f486e428412dc9"), ""},
+	{`null`, "", ""},
+	{`""`, "", ""},
+	{`"4d88e15b60f486e428412dc"`, "", `Invalid ObjectId in JSON: "4d88e15b60f486e428412dc"`},
+	{`"4d88e15b60f486e428412dcZ"`, "", `Invalid ObjectId in JSON: "4d88e15b60f486e428412dcZ" .*`},
+	{`4d88e15b60f486e428412dc9`, "", `Invalid ObjectId in JSON: 4d88e15b60f486e428412dc9`},
+}
+
+func (s *S) TestObjectIdUnmarshalJSON(c *C) {
+	for i, item := range jsonIdItems {
+		id := bson.ObjectId("whatever")
+		err := id.UnmarshalJSON([]byte(item.json))
+		if item.error != "" {
+			c.Assert(err, Matches, item.error, Bug("Failed on item %d", i))
+		} else {
+			c.Assert(err, IsNil, Bug("Failed on item %d", i))
+			c.Assert(id, Equals, item.id, Bug("Failed on item %d", i))
+		}
+	}
+}
+
 // --------------------------------------------------------------------------
 // ObjectId parts extraction tests.
 
@@ -1045,6 +3379,56 @@ func (s *S) TestObjectIdPartsExtraction(c *C) {
 	}
 }
 
+var objectIdCompareItems = []struct {
+	a, b   bson.ObjectId
+	result int
+}{
+	{bson.ObjectIdHex("4d88e15b60f486e428412dc9"), bson.ObjectIdHex("4d88e15b60f486e428412dc9"), 0},
+	{bson.ObjectIdHex("4d88e15b60f486e428412dc9"), bson.ObjectIdHex("4d88e15c0000000000000000"), -1},
+	{bson.ObjectIdHex("4d88e15c000000000000000a"), bson.ObjectIdHex("4d88e15b60f486e428412dc9"), 1},
+	{bson.ObjectIdHex("00000000aabbccddee000001"), bson.ObjectIdHex("00000000aabbccddee000002"), -1},
+	{bson.ObjectId(""), bson.ObjectIdHex("000000000000000000000000"), -1},
+	{bson.ObjectId("\x00\x00"), bson.ObjectId(""), 1},
+}
+
+func (s *S) TestObjectIdIsZero(c *C) {
+	c.Assert(bson.ObjectId("").IsZero(), Equals, true)
+	c.Assert(bson.ZeroObjectId.IsZero(), Equals, true)
+	c.Assert(bson.ObjectIdHex("000000000000000000000000").IsZero(), Equals, true)
+	c.Assert(bson.ObjectIdHex("000000000000000000000001").IsZero(), Equals, false)
+	c.Assert(bson.NewObjectId().IsZero(), Equals, false)
+}
+
+func (s *S) TestObjectIdCompare(c *C) {
+	for i, item := range objectIdCompareItems {
+		c.Assert(item.a.Compare(item.b), Equals, item.result, Bug("Failed on item %d", i))
+		c.Assert(item.b.Compare(item.a), Equals, -item.result, Bug("Failed on item %d", i))
+		c.Assert(item.a.Before(item.b), Equals, item.result < 0, Bug("Failed on item %d", i))
+	}
+}
+
+func (s *S) TestObjectIdEqual(c *C) {
+	a := bson.ObjectIdHex("4d88e15b60f486e428412dc9")
+	b := bson.ObjectIdHex("4d88e15b60f486e428412dca")
+	c.Assert(a.Equal(a), Equals, true)
+	c.Assert(a.Equal(bson.ObjectIdHex(a.Hex())), Equals, true)
+	c.Assert(a.Equal(b), Equals, false)
+	c.Assert(bson.ObjectId("").Equal(""), Equals, false)
+	c.Assert(bson.ObjectId("short").Equal("short"), Equals, false)
+	c.Assert(a.Equal(a[:11]), Equals, false)
+}
+
+func (s *S) TestFrozenClock(c *C) {
+	frozen := time.Unix(1258387200, 123456789)
+	restore := bson.SetTimeNow(func() time.Time { return frozen })
+	defer bson.SetTimeNow(restore)
+
+	id := bson.NewObjectId()
+	c.Assert(string(id[:4]), Equals, "\x4b\x01\x77\x00")
+	c.Assert(id.Timestamp(), Equals, int32(1258387200))
+	c.Assert(bson.Now(), Equals, bson.Timestamp(1258387200123e6))
+}
+
 func (s *S) TestNow(c *C) {
 	before := time.Nanoseconds()
 	time.Sleep(1e6)
@@ -1080,12 +3464,67 @@ func (s *S) TestNewObjectId(c *C) {
 		c.Assert(id.Machine(), Equals, prevId.Machine())
 		// Check that pids are the same
 		c.Assert(id.Pid(), Equals, prevId.Pid())
-		// Test for proper increment
-		delta := int(id.Counter() - prevId.Counter())
+		// Test for proper increment, which may wrap around since the
+		// counter starts at a random value
+		delta := int(id.Counter()-prevId.Counter()) & 0xFFFFFF
 		c.Assert(delta, Equals, 1, Bug("Wrong increment in generated ObjectId"))
 	}
 }
 
+func (s *S) TestSetMachineId(c *C) {
+	machine := bson.NewObjectId().Machine()
+	defer bson.SetMachineId(machine)
+
+	bson.SetMachineId([]byte{1, 2, 3})
+	c.Assert(bson.NewObjectId().Machine(), Equals, []byte{1, 2, 3})
+}
+
+func (s *S) TestSetMachineIdBadLength(c *C) {
+	defer func() {
+		c.Assert(recover(), Equals, "Machine id must be exactly 3 bytes long (got 2)")
+	}()
+	bson.SetMachineId([]byte{1, 2})
+}
+
+func (s *S) TestNewObjectIdWith(c *C) {
+	before := int32(time.Seconds())
+	id := bson.NewObjectIdWith([]byte{1, 2, 3}, 0x0405, 0xAA060708)
+	after := int32(time.Seconds())
+	c.Assert(id.Machine(), Equals, []byte{1, 2, 3})
+	c.Assert(id.Pid(), Equals, uint16(0x0405))
+	c.Assert(id.Counter(), Equals, int32(0x060708))
+	c.Assert(id.Timestamp() >= before && id.Timestamp() <= after, Equals, true)
+}
+
+func (s *S) TestNewObjectIdWithBadLength(c *C) {
+	defer func() {
+		c.Assert(recover(), Equals, "Machine id must be exactly 3 bytes long (got 4)")
+	}()
+	bson.NewObjectIdWith([]byte{1, 2, 3, 4}, 0, 0)
+}
+
+func (s *S) TestNewObjectIds(c *C) {
+	c.Assert(bson.NewObjectIds(0), Equals, []bson.ObjectId{})
+
+	ids := bson.NewObjectIds(100)
+	c.Assert(len(ids), Equals, 100)
+	next := bson.NewObjectId()
+	for i, id := range ids {
+		c.Assert(id.Valid(), Equals, true)
+		c.Assert(id.Machine(), Equals, ids[0].Machine())
+		c.Assert(id.Pid(), Equals, ids[0].Pid())
+		c.Assert(id.Counter(), Equals, (ids[0].Counter()+int32(i))&0xFFFFFF)
+	}
+	c.Assert(next.Counter(), Equals, (ids[99].Counter()+1)&0xFFFFFF)
+}
+
+func (s *S) TestNewObjectIdsBadCount(c *C) {
+	defer func() {
+		c.Assert(recover(), Equals, "Can't generate -1 ObjectIds in a single batch")
+	}()
+	bson.NewObjectIds(-1)
+}
+
 func (s *S) TestNewObjectIdSeconds(c *C) {
 	sec := int32(time.Seconds())
 	id := bson.NewObjectIdSeconds(sec)
@@ -1094,3 +3533,558 @@ func (s *S) TestNewObjectIdSeconds(c *C) {
 	c.Assert(int(id.Pid()), Equals, 0)
 	c.Assert(int(id.Counter()), Equals, 0)
 }
+
+func (s *S) TestNewObjectIdFromTime(c *C) {
+	t := time.Date(2011, 5, 24, 10, 20, 30, 0, time.FixedZone("UTC-3", -3*3600))
+	id := bson.NewObjectIdFromTime(t)
+	c.Assert(id.Timestamp(), Equals, int32(t.Unix()))
+	c.Assert(id.Machine(), Equals, []byte{0x00, 0x00, 0x00})
+	c.Assert(int(id.Pid()), Equals, 0)
+	c.Assert(int(id.Counter()), Equals, 0)
+	c.Assert(id, Equals, bson.NewObjectIdSeconds(int32(t.Unix())))
+}
+
+// --------------------------------------------------------------------------
+// Document stream tests.
+
+// shortWriter accepts at most three bytes per Write call.
+type shortWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *shortWriter) Write(data []byte) (n int, err os.Error) {
+	if len(data) > 3 {
+		data = data[:3]
+	}
+	return w.buf.Write(data)
+}
+
+func (s *S) TestStreamEncoder(c *C) {
+	var buf bytes.Buffer
+	enc := bson.NewStreamEncoder(&buf)
+	for _, item := range sampleItems {
+		err := enc.Encode(item.obj)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(buf.String(), Equals, sampleItems[0].data+sampleItems[1].data)
+}
+
+func (s *S) TestStreamEncoderShortWrites(c *C) {
+	w := &shortWriter{}
+	enc := bson.NewStreamEncoder(w)
+	for _, item := range sampleItems {
+		err := enc.Encode(item.obj)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(w.buf.String(), Equals, sampleItems[0].data+sampleItems[1].data)
+}
+
+func (s *S) TestStreamEncoderMarshalError(c *C) {
+	var buf bytes.Buffer
+	enc := bson.NewStreamEncoder(&buf)
+	err := enc.Encode(int64(123))
+	c.Assert(err, Matches, "Can't marshal int64 as a BSON document")
+	c.Assert(buf.Len(), Equals, 0)
+}
+
+func (s *S) TestStreamDecoder(c *C) {
+	buf := bytes.NewBufferString(sampleItems[0].data + sampleItems[1].data)
+	dec := bson.NewStreamDecoder(buf)
+	for _, item := range sampleItems {
+		m := bson.M{}
+		err := dec.Decode(m)
+		c.Assert(err, IsNil)
+		c.Assert(m, Equals, item.obj)
+	}
+	err := dec.Decode(bson.M{})
+	c.Assert(err, Equals, os.EOF)
+}
+
+func (s *S) TestStreamDecoderTruncated(c *C) {
+	data := sampleItems[0].data
+	for _, l := range []int{2, 4, len(data) - 1} {
+		dec := bson.NewStreamDecoder(bytes.NewBufferString(data[:l]))
+		err := dec.Decode(bson.M{})
+		c.Assert(err, Equals, io.ErrUnexpectedEOF, Bug("Failed with length %d", l))
+	}
+}
+
+func (s *S) TestStreamDecoderBadLength(c *C) {
+	dec := bson.NewStreamDecoder(bytes.NewBufferString("\xff\xff\xff\xff"))
+	err := dec.Decode(bson.M{})
+	c.Assert(err, Matches, "Document is corrupted")
+
+	dec = bson.NewStreamDecoder(bytes.NewBufferString(sampleItems[0].data))
+	dec.MaxSize = 8
+	err = dec.Decode(bson.M{})
+	c.Assert(err, Matches, "Document size 22 exceeds the maximum of 8 bytes")
+}
+
+func (s *S) TestStreamDecoderMaxSizeAboveGlobal(c *C) {
+	defer func(old int) { bson.MaxDocumentSize = old }(bson.MaxDocumentSize)
+	bson.MaxDocumentSize = 8
+
+	data := sampleItems[0].data
+	err := bson.Unmarshal([]byte(data), bson.M{})
+	c.Assert(err, Matches, "Document size 22 exceeds the maximum of 8 bytes")
+
+	dec := bson.NewStreamDecoder(bytes.NewBufferString(data))
+	dec.MaxSize = 64
+	m := bson.M{}
+	c.Assert(dec.Decode(m), IsNil)
+	c.Assert(m["hello"], Equals, "world")
+}
+
+// --------------------------------------------------------------------------
+// Document builder tests.
+
+func (s *S) TestDocBuilder(c *C) {
+	t := time.Unix(1258387200, 0).UTC()
+	id := bson.ObjectIdHex("4d88e15b60f486e428412dc9")
+	dec := parseDecimal128("1.5")
+
+	b := bson.NewDocBuilder()
+	b.AppendDouble("d", 1.5)
+	b.AppendString("s", "str")
+	b.AppendBinary("b", 0x80, []byte("bin"))
+	b.AppendObjectId("_id", id)
+	b.AppendBool("t", true)
+	b.AppendTime("tm", t)
+	b.AppendNull("n")
+	b.AppendInt32("i", 1)
+	b.AppendInt64("l", 2)
+	b.AppendDecimal128("dec", dec)
+	b.StartDocument("sub")
+	b.AppendInt32("a", 3)
+	b.StartArray("arr")
+	b.AppendString("ignored", "x")
+	c.Assert(b.AppendValue("ignored", bson.M{"y": true}), IsNil)
+	b.End()
+	b.End()
+	b.AppendRaw("raw", bson.Raw{0x02, []byte("\x02\x00\x00\x00r\x00")})
+	data := b.Finish()
+
+	expected, err := bson.Marshal(bson.D{
+		{"d", 1.5},
+		{"s", "str"},
+		{"b", bson.Binary{0x80, []byte("bin")}},
+		{"_id", id},
+		{"t", true},
+		{"tm", t},
+		{"n", nil},
+		{"i", int32(1)},
+		{"l", int64(2)},
+		{"dec", dec},
+		{"sub", bson.D{{"a", int32(3)}, {"arr", []interface{}{"x", bson.M{"y": true}}}}},
+		{"raw", "r"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, string(expected))
+
+	b.Reset()
+	c.Assert(string(b.Finish()), Equals, "\x05\x00\x00\x00\x00")
+}
+
+func (s *S) TestDocBuilderAppendValueError(c *C) {
+	b := bson.NewDocBuilder()
+	b.AppendInt32("a", 1)
+	err := b.AppendValue("ch", make(chan int))
+	c.Assert(err, Matches, "Can't marshal chan int: type has no BSON representation")
+	data, _ := bson.Marshal(bson.D{{"a", int32(1)}})
+	c.Assert(string(b.Finish()), Equals, string(data))
+}
+
+func (s *S) TestDocBuilderUnbalanced(c *C) {
+	b := bson.NewDocBuilder()
+	b.StartDocument("a")
+	defer func() {
+		c.Assert(recover(), Equals, "DocBuilder.Finish called with unended documents or arrays")
+	}()
+	b.Finish()
+}
+
+// --------------------------------------------------------------------------
+// Decimal128 tests.
+
+var decimalRoundtripItems = []string{
+	"0", "-0", "1", "-1", "0.001", "0.1", "1.5", "-1.5", "100", "1.000",
+	"0.00123400", "-0.00000100", "1E-7", "1E+3", "0E+3", "1.23E+5",
+	"12345678901234567890", "1.234567890123456789012345678901234",
+	"9.999999999999999999999999999999999E+6144", "1E-6176",
+	"NaN", "Infinity", "-Infinity",
+}
+
+func (s *S) TestDecimal128Roundtrip(c *C) {
+	for _, str := range decimalRoundtripItems {
+		d, err := bson.ParseDecimal128(str)
+		c.Assert(err, IsNil, Bug("Failed on %q", str))
+		c.Assert(d.String(), Equals, str)
+
+		data, err := bson.Marshal(bson.M{"d": d})
+		c.Assert(err, IsNil)
+		var doc struct{ D bson.Decimal128 }
+		err = bson.Unmarshal(data, &doc)
+		c.Assert(err, IsNil)
+		c.Assert(doc.D.String(), Equals, str)
+	}
+}
+
+var decimalParseItems = []struct{ in, out string }{
+	{"+1", "1"},
+	{"1.050E+3", "1050"},
+	{"-1.00E-6", "-0.00000100"},
+	{"nan", "NaN"},
+	{"-inf", "-Infinity"},
+	{"+Infinity", "Infinity"},
+}
+
+func (s *S) TestParseDecimal128(c *C) {
+	for _, item := range decimalParseItems {
+		d, err := bson.ParseDecimal128(item.in)
+		c.Assert(err, IsNil, Bug("Failed on %q", item.in))
+		c.Assert(d.String(), Equals, item.out)
+	}
+}
+
+func (s *S) TestParseDecimal128Errors(c *C) {
+	for _, str := range []string{"", ".", "1..2", "abc", "1E", "1e+", "1.2.3", "1E+99999", "12345678901234567890123456789012345"} {
+		_, err := bson.ParseDecimal128(str)
+		c.Assert(err, Matches, "Cannot parse .* as a decimal128", Bug("Failed on %q", str))
+	}
+}
+
+// --------------------------------------------------------------------------
+// MinKey and MaxKey tests.
+
+func (s *S) TestUnmarshalOrderKeys(c *C) {
+	data, err := bson.Marshal(bson.D{{"min", bson.MinKey}, {"max", bson.MaxKey}})
+	c.Assert(err, IsNil)
+
+	m := bson.M{}
+	err = bson.Unmarshal(data, m)
+	c.Assert(err, IsNil)
+	c.Assert(m["min"], Equals, bson.MinKey)
+	c.Assert(m["max"], Equals, bson.MaxKey)
+	_, ok := m["max"].(bson.OrderKey)
+	c.Assert(ok, Equals, true)
+
+	var doc struct{ Min, Max bson.OrderKey }
+	err = bson.Unmarshal(data, &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.Min, Equals, bson.MinKey)
+	c.Assert(doc.Max, Equals, bson.MaxKey)
+}
+
+// --------------------------------------------------------------------------
+// JavaScript tests.
+
+type jsDoc struct {
+	Code bson.JS
+}
+
+func (s *S) TestJSRoundtrip(c *C) {
+	items := []bson.JS{
+		{"function() { return x; }", nil},
+		{"function() { return x; }", bson.M{"x": 1, "y": bson.M{"z": "a"}}},
+	}
+	for _, js := range items {
+		data, err := bson.Marshal(&jsDoc{js})
+		c.Assert(err, IsNil)
+
+		doc := &jsDoc{}
+		err = bson.Unmarshal(data, doc)
+		c.Assert(err, IsNil)
+		c.Assert(doc.Code, Equals, js)
+
+		m := bson.M{}
+		err = bson.Unmarshal(data, m)
+		c.Assert(err, IsNil)
+		c.Assert(m["code"], Equals, js)
+	}
+}
+
+func (s *S) TestJSWithScopeBadLength(c *C) {
+	data := wrapInDoc("\x0F_\x00\x15\x00\x00\x00\x05\x00\x00\x00code\x00" +
+		"\x07\x00\x00\x00\x0A\x00\x00")
+	err := bson.Unmarshal([]byte(data), bson.M{})
+	c.Assert(err, Matches, "Document is corrupted")
+}
+
+// --------------------------------------------------------------------------
+// RegEx tests.
+
+func (s *S) TestRegExNormalize(c *C) {
+	re := bson.RegEx{"ab", "xsmi"}
+	c.Assert(re.Normalize(), Equals, bson.RegEx{"ab", "imsx"})
+	c.Assert(re.Options, Equals, "xsmi")
+}
+
+// --------------------------------------------------------------------------
+// Binary UUID tests.
+
+func (s *S) TestBinaryUUID(c *C) {
+	uuid := [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	b := bson.NewBinaryUUID(uuid)
+	c.Assert(b.Kind, Equals, byte(0x04))
+	c.Assert(b.Data, Equals, uuid[:])
+
+	data, err := bson.Marshal(bson.M{"u": b})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x05u\x00\x10\x00\x00\x00\x04"+string(uuid[:])))
+
+	var doc struct{ U bson.Binary }
+	err = bson.Unmarshal(data, &doc)
+	c.Assert(err, IsNil)
+	out, err := doc.U.UUID()
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, uuid)
+
+	out, err = bson.Binary{0x03, uuid[:]}.UUID()
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, uuid)
+}
+
+type uuidDoc struct {
+	Id bson.UUID "_id"
+}
+
+func (s *S) TestMarshalUUID(c *C) {
+	uuid := bson.UUID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	data, err := bson.Marshal(uuidDoc{uuid})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x05_id\x00\x10\x00\x00\x00\x04"+string(uuid[:])))
+
+	doc := &uuidDoc{}
+	err = bson.Unmarshal(data, doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.Id, Equals, uuid)
+
+	// The legacy subtype is accepted as well.
+	data, err = bson.Marshal(bson.M{"_id": bson.Binary{0x03, uuid[:]}})
+	c.Assert(err, IsNil)
+	doc = &uuidDoc{}
+	err = bson.Unmarshal(data, doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.Id, Equals, uuid)
+
+	// Other binary kinds are skipped.
+	data, err = bson.Marshal(bson.M{"_id": bson.Binary{0x80, uuid[:]}})
+	c.Assert(err, IsNil)
+	doc = &uuidDoc{}
+	err = bson.Unmarshal(data, doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.Id, Equals, bson.UUID{})
+}
+
+func (s *S) TestBinaryUUIDErrors(c *C) {
+	_, err := bson.Binary{0x80, make([]byte, 16)}.UUID()
+	c.Assert(err, Matches, "Binary subtype 0x80 is not a UUID")
+	_, err = bson.Binary{0x04, make([]byte, 15)}.UUID()
+	c.Assert(err, Matches, "Binary UUID has 15 bytes rather than 16")
+}
+
+// --------------------------------------------------------------------------
+// Extended JSON tests.
+
+var extJSONItems = []struct {
+	value interface{}
+	json  string
+}{
+	{float64(1), `{"$numberDouble":"1.0"}`},
+	{float64(-1.5), `{"$numberDouble":"-1.5"}`},
+	{float64(1e300), `{"$numberDouble":"1E+300"}`},
+	{math.NaN(), `{"$numberDouble":"NaN"}`},
+	{math.Inf(1), `{"$numberDouble":"Infinity"}`},
+	{math.Inf(-1), `{"$numberDouble":"-Infinity"}`},
+	{"a\"b\\c\n\x01é", `"a\"b\\c\n\u0001é"`},
+	{bson.D{{"b", true}, {"a", false}}, `{"b":true,"a":false}`},
+	{[]interface{}{1, "x"}, `[{"$numberInt":"1"},"x"]`},
+	{[]byte("yo"), `{"$binary":{"base64":"eW8=","subType":"00"}}`},
+	{bson.Binary{0x80, []byte("udef")}, `{"$binary":{"base64":"dWRlZg==","subType":"80"}}`},
+	{bson.Undefined, `{"$undefined":true}`},
+	{bson.ObjectIdHex("4d88e15b60f486e428412dc9"), `{"$oid":"4d88e15b60f486e428412dc9"}`},
+	{time.Unix(0, 258e6), `{"$date":{"$numberLong":"258"}}`},
+	{nil, `null`},
+	{bson.RegEx{"a\\.b", "im"}, `{"$regularExpression":{"pattern":"a\\.b","options":"im"}}`},
+	{bson.DBPointer{"db.c", bson.ObjectIdHex("4d88e15b60f486e428412dc9")},
+		`{"$dbPointer":{"$ref":"db.c","$id":{"$oid":"4d88e15b60f486e428412dc9"}}}`},
+	{bson.JS{"code", nil}, `{"$code":"code"}`},
+	{bson.JS{"code", bson.M{"x": 1}}, `{"$code":"code","$scope":{"x":{"$numberInt":"1"}}}`},
+	{bson.Symbol("sym"), `{"$symbol":"sym"}`},
+	{bson.MongoTimestamp(5<<32 | 2), `{"$timestamp":{"t":5,"i":2}}`},
+	{int64(-1), `{"$numberLong":"-1"}`},
+	{parseDecimal128("0.001"), `{"$numberDecimal":"0.001"}`},
+	{bson.MinKey, `{"$minKey":1}`},
+	{bson.MaxKey, `{"$maxKey":1}`},
+}
+
+func (s *S) TestMarshalExtJSON(c *C) {
+	for i, item := range extJSONItems {
+		data, err := bson.Marshal(bson.M{"_": item.value})
+		c.Assert(err, IsNil)
+		out, err := bson.ToExtJSON(data)
+		c.Assert(err, IsNil, Bug("Failed on item %d", i))
+		c.Assert(string(out), Equals, `{"_":`+item.json+`}`, Bug("Failed on item %d", i))
+
+		kind, data, err := bson.MarshalValue(item.value)
+		c.Assert(err, IsNil)
+		out, err = bson.Raw{kind, data}.MarshalExtJSON()
+		c.Assert(err, IsNil, Bug("Failed on item %d", i))
+		c.Assert(string(out), Equals, item.json, Bug("Failed on item %d", i))
+	}
+}
+
+func (s *S) TestMarshalExtJSONCorrupted(c *C) {
+	_, err := bson.ToExtJSON([]byte(wrapInDoc("\x02a\x00\x05\x00\x00\x00ab")))
+	c.Assert(err, Matches, "Document is corrupted")
+}
+
+func (s *S) TestParseExtJSON(c *C) {
+	for i, item := range extJSONItems {
+		data, err := bson.ParseExtJSON([]byte(`{"_":` + item.json + `}`))
+		c.Assert(err, IsNil, Bug("Failed on item %d", i))
+		expected, err := bson.Marshal(bson.M{"_": item.value})
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, string(expected), Bug("Failed on item %d", i))
+	}
+}
+
+var parseExtJSONItems = []struct {
+	json  string
+	value interface{}
+}{
+	{`{"a": 1, "b": 2147483648, "c": 1.5, "d": [true, null]}`,
+		bson.D{{"a", 1}, {"b", int64(2147483648)}, {"c", 1.5}, {"d", []interface{}{true, nil}}}},
+	{`{"a": {"$gt": 1}}`, bson.M{"a": bson.M{"$gt": 1}}},
+	{`{"a": {"$regex": "a.b", "$options": "i"}}`, bson.M{"a": bson.RegEx{"a.b", "i"}}},
+	{`{"a": {"$regex": "a.b"}}`, bson.M{"a": bson.RegEx{"a.b", ""}}},
+	{`{"a": {"$date": "1970-01-01T00:00:00.258Z"}}`, bson.M{"a": time.Unix(0, 258e6)}},
+	{`{"a": {"$date": 258}}`, bson.M{"a": time.Unix(0, 258e6)}},
+	{`{"a": {"$binary": "eW8=", "$type": "80"}}`, bson.M{"a": bson.Binary{0x80, []byte("yo")}}},
+	{`{"a": "\ud83d\ude00 \/ \u00e9"}`, bson.M{"a": "\U0001F600 / \u00e9"}},
+	{`{}`, bson.M{}},
+}
+
+func (s *S) TestParseExtJSONRelaxed(c *C) {
+	for i, item := range parseExtJSONItems {
+		data, err := bson.ParseExtJSON([]byte(item.json))
+		c.Assert(err, IsNil, Bug("Failed on item %d", i))
+		expected, err := bson.Marshal(item.value)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, string(expected), Bug("Failed on item %d", i))
+	}
+}
+
+var parseExtJSONErrorItems = []struct {
+	json, error string
+}{
+	{`{"a": {"b": {"$oid": "xyz"}}}`, `Invalid Extended JSON \$oid wrapper at key "a.b"`},
+	{`{"a": [{"$numberLong": 1}]}`, `Invalid Extended JSON \$numberLong wrapper at key "a.0"`},
+	{`{"a": {"$binary": {"base64": "eW8=", "subType": "100"}}}`, `Invalid Extended JSON \$binary wrapper at key "a"`},
+	{`{"a": {"$date": "yesterday"}}`, `Invalid Extended JSON \$date wrapper at key "a"`},
+	{`{"a": }`, "Invalid Extended JSON syntax at offset 6"},
+	{`{"a": 1} x`, "Invalid Extended JSON syntax at offset 9"},
+	{`{"a": "b`, "Invalid Extended JSON syntax at offset 8"},
+	{`[1]`, "Extended JSON document must be an object"},
+}
+
+func (s *S) TestParseExtJSONErrors(c *C) {
+	for _, item := range parseExtJSONErrorItems {
+		_, err := bson.ParseExtJSON([]byte(item.json))
+		c.Assert(err, Matches, item.error, Bug("Input: %s", item.json))
+	}
+}
+
+type jsonRawDoc struct {
+	Meta json.RawMessage
+}
+
+func (s *S) TestMarshalJSONRawMessage(c *C) {
+	doc := &jsonRawDoc{json.RawMessage(`{"a":1,"b":[true,"x",null],"c":{"d":1.5},"id":{"$oid":"4d88e15b60f486e428412dc9"}}`)}
+	data, err := bson.Marshal(doc)
+	c.Assert(err, IsNil)
+	m := bson.M{}
+	c.Assert(bson.Unmarshal(data, m), IsNil)
+	c.Assert(m, Equals, bson.M{"meta": bson.M{
+		"a":  1,
+		"b":  []interface{}{true, "x", nil},
+		"c":  bson.M{"d": 1.5},
+		"id": bson.ObjectIdHex("4d88e15b60f486e428412dc9"),
+	}})
+
+	var out jsonRawDoc
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(string(out.Meta), Equals, string(doc.Meta))
+
+	// Values other than objects are supported as well.
+	for _, v := range []string{`"hi"`, `42`, `-1.5`, `[1,2]`, `false`, `null`} {
+		data, err = bson.Marshal(&jsonRawDoc{json.RawMessage(v)})
+		c.Assert(err, IsNil)
+		out = jsonRawDoc{}
+		c.Assert(bson.Unmarshal(data, &out), IsNil)
+		if v == "null" {
+			c.Assert(out.Meta, IsNil)
+		} else {
+			c.Assert(string(out.Meta), Equals, v)
+		}
+	}
+
+	data, err = bson.Marshal(&jsonRawDoc{})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x0Ameta\x00"))
+
+	_, err = bson.Marshal(&jsonRawDoc{json.RawMessage(`{"a":}`)})
+	c.Assert(err, Matches, `field "meta": Invalid Extended JSON syntax at offset 5`)
+}
+
+// --------------------------------------------------------------------------
+// Equal tests.
+
+var equalItems = []struct {
+	a, b  interface{}
+	equal bool
+}{
+	{1, 1, true},
+	{1, 2, false},
+	{int32(1), int64(1), true},
+	{int64(1), 1.0, true},
+	{1.5, 1, false},
+	{int64(1<<53 + 1), float64(1 << 53), false},
+	{math.NaN(), math.NaN(), true},
+	{math.NaN(), 0, false},
+	{"a", "a", true},
+	{"a", "b", false},
+	{"a", bson.Symbol("a"), false},
+	{"1", 1, false},
+	{nil, nil, true},
+	{nil, bson.Undefined, false},
+	{bson.ObjectIdHex("4d88e15b60f486e428412dc9"), bson.ObjectIdHex("4d88e15b60f486e428412dc9"), true},
+	{bson.ObjectIdHex("4d88e15b60f486e428412dc9"), bson.ObjectIdHex("4d88e15b60f486e428412dca"), false},
+	{[]byte("abc"), bson.Binary{0x00, []byte("abc")}, true},
+	{[]byte("abc"), bson.Binary{0x80, []byte("abc")}, false},
+	{parseDecimal128("1.0"), parseDecimal128("1.0"), true},
+	{parseDecimal128("1.0"), parseDecimal128("1.00"), false},
+	{parseDecimal128("1"), 1, false},
+	{bson.M{"a": 1, "b": bson.M{"c": "d"}}, bson.D{{"b", bson.D{{"c", "d"}}}, {"a", int64(1)}}, true},
+	{bson.M{"a": 1}, bson.M{"a": 1, "b": 2}, false},
+	{bson.M{"a": 1, "b": 2}, bson.M{"a": 1, "c": 2}, false},
+	{bson.D{{"a", 1}, {"a", 2}}, bson.M{"a": 2}, true},
+	{bson.M{}, []interface{}{}, false},
+	{[]interface{}{1, "a"}, []int64{1}, false},
+	{[]interface{}{1, 2}, []int64{1, 2}, true},
+	{[]interface{}{1, 2}, []int64{2, 1}, false},
+	{bson.JS{"f", bson.M{"a": 1, "b": 2}}, bson.JS{"f", bson.D{{"b", 2.0}, {"a", 1}}}, true},
+	{bson.JS{"f", bson.M{"a": 1}}, bson.JS{"g", bson.M{"a": 1}}, false},
+	{bson.JS{"f", nil}, bson.JS{"f", bson.M{}}, false},
+	{bson.Raw{0x10, []byte("\x01\x00\x00\x00")}, 1, true},
+	{bson.Raw{0x03, []byte("\x05\x00\x00\x00")}, bson.M{}, true},
+	{bson.Raw{0x03, []byte("\x06\x00\x00\x00")}, bson.M{}, false},
+	{1i, 1i, false},
+}
+
+func (s *S) TestEqual(c *C) {
+	for i, item := range equalItems {
+		c.Assert(bson.Equal(item.a, item.b), Equals, item.equal, Bug("Failed on item %d", i))
+		c.Assert(bson.Equal(item.b, item.a), Equals, item.equal, Bug("Failed on item %d", i))
+	}
+}
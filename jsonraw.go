@@ -0,0 +1,84 @@
+// gobson - BSON library for Go.
+//
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bson
+
+import (
+	"json"
+	"reflect"
+)
+
+// --------------------------------------------------------------------------
+// Support for the json.RawMessage type.
+//
+// Values of type json.RawMessage are marshaled as the BSON value
+// equivalent to the JSON they hold, so that a JSON object is stored as
+// a regular document rather than as binary data.  The JSON may also use
+// the wrappers of MongoDB Extended JSON, such as {"$oid": "..."}, as
+// understood by ParseExtJSON.  An empty or nil message is marshaled as
+// null.  When unmarshaling, any value is rendered back as JSON, using
+// plain JSON numbers for int32, int64 and finite double values, and the
+// canonical Extended JSON format for values without a JSON equivalent.
+// A null value unmarshals as a nil message.
+//
+// The support is implemented as a codec registered via RegisterCodec, so
+// it may be replaced in the same way.
+
+func init() {
+	RegisterCodec(reflect.TypeOf(json.RawMessage{}), encodeJSONRaw, decodeJSONRaw)
+}
+
+func encodeJSONRaw(v reflect.Value) (kind byte, data []byte) {
+	msg := v.Bytes()
+	if len(msg) == 0 {
+		return KindNull, nil
+	}
+	p := &extJSONParser{in: msg}
+	value := p.readValue()
+	if p.peek() != 0 {
+		p.syntaxError()
+	}
+	kind, data, err := MarshalValue(value)
+	if err != nil {
+		panic(err)
+	}
+	return kind, data
+}
+
+func decodeJSONRaw(kind byte, data []byte, v reflect.Value) bool {
+	if kind == KindNull {
+		v.Set(reflect.Zero(v.Type()))
+		return true
+	}
+	e := &extJSONEncoder{d: &decoder{in: data}, relaxed: true}
+	e.addElem(kind)
+	v.SetBytes(e.out)
+	return true
+}
@@ -0,0 +1,126 @@
+// gobson - BSON library for Go.
+//
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bson
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// --------------------------------------------------------------------------
+// Writing of document streams.
+
+// StreamEncoder writes a sequence of BSON documents into an io.Writer,
+// one after the other, as done for instance by mongodump.
+type StreamEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewStreamEncoder returns a new StreamEncoder writing documents into w.
+func NewStreamEncoder(w io.Writer) *StreamEncoder {
+	return &StreamEncoder{w: w, buf: make([]byte, 0, initialBufferSize)}
+}
+
+// Encode marshals the in document as done by the Marshal function, and
+// writes the result into the underlying writer.  The same internal buffer
+// is reused for every document encoded.
+func (enc *StreamEncoder) Encode(in interface{}) os.Error {
+	data, err := MarshalTo(in, enc.buf)
+	if err != nil {
+		return err
+	}
+	enc.buf = data
+	for len(data) > 0 {
+		n, err := enc.w.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------
+// Reading of document streams.
+
+// StreamDecoder reads a sequence of BSON documents from an io.Reader,
+// such as a file holding the concatenation of several documents.
+type StreamDecoder struct {
+	r io.Reader
+
+	// MaxSize is the maximum size in bytes of a document accepted by
+	// Decode, protecting against huge allocations when the leading length
+	// of a document is corrupted.  It defaults to MaxDocumentSize, and
+	// replaces that limit for the documents decoded, so it may be set
+	// either above or below it.
+	MaxSize int
+}
+
+// NewStreamDecoder returns a new StreamDecoder reading documents from r.
+func NewStreamDecoder(r io.Reader) *StreamDecoder {
+	return &StreamDecoder{r: r, MaxSize: MaxDocumentSize}
+}
+
+// Decode reads the next document from the underlying reader and unmarshals
+// it into out as done by the Unmarshal function.  At the end of the stream
+// os.EOF is returned, while io.ErrUnexpectedEOF is returned if the stream
+// ends in the middle of a document.
+func (dec *StreamDecoder) Decode(out interface{}) os.Error {
+	var head [4]byte
+	_, err := io.ReadFull(dec.r, head[:])
+	if err != nil {
+		return err
+	}
+	l := int(int32(uint32(head[0]) | uint32(head[1])<<8 | uint32(head[2])<<16 | uint32(head[3])<<24))
+	if l < 5 {
+		return os.ErrorString("Document is corrupted")
+	}
+	if l > dec.MaxSize {
+		return os.NewError(fmt.Sprintf("Document size %d exceeds the maximum of %d bytes", l, dec.MaxSize))
+	}
+	// Unmarshaled values such as binary data may reference the read
+	// buffer, so a new one is allocated for each document.
+	data := make([]byte, l)
+	copy(data, head[:])
+	_, err = io.ReadFull(dec.r, data[4:])
+	if err == os.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	return unmarshal(&decoder{in: data, maxSize: dec.MaxSize}, out)
+}